@@ -0,0 +1,84 @@
+// Copyright (c) David Capello. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE.txt file.
+
+package htex
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// CacheStats contains counters of the cache of parsed files to debug
+// its usage.
+type CacheStats struct {
+	Hits          uint64 // Files found in the cache
+	Misses        uint64 // Files that were parsed
+	Invalidations uint64 // Cached files that were modified or deleted
+	Entries       int    // Files in the cache
+}
+
+type cacheEntry struct {
+	hf      *HtexFile
+	modTime time.Time
+	size    int64
+}
+
+// fileCache keeps parsed .htex files in memory to avoid parsing them
+// again in each request. An entry is valid while the modification
+// time and size of the file don't change. It can be used from
+// several goroutines at the same time.
+type fileCache struct {
+	mutex   sync.Mutex
+	entries map[string]cacheEntry
+	stats   CacheStats
+}
+
+func newFileCache() *fileCache {
+	return &fileCache{entries: make(map[string]cacheEntry)}
+}
+
+// get returns the parsed file if it's in the cache and it's still
+// valid for the given file info (or nil in other case).
+func (c *fileCache) get(fn string, info os.FileInfo) *HtexFile {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, ok := c.entries[fn]
+	if ok && entry.modTime.Equal(info.ModTime()) && entry.size == info.Size() {
+		c.stats.Hits++
+		return entry.hf
+	}
+	if ok {
+		c.stats.Invalidations++
+		delete(c.entries, fn)
+	}
+	c.stats.Misses++
+	return nil
+}
+
+func (c *fileCache) put(fn string, info os.FileInfo, hf *HtexFile) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries[fn] = cacheEntry{hf: hf, modTime: info.ModTime(), size: info.Size()}
+}
+
+// remove deletes the entry of a file that doesn't exist anymore.
+func (c *fileCache) remove(fn string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, ok := c.entries[fn]; ok {
+		c.stats.Invalidations++
+		delete(c.entries, fn)
+	}
+}
+
+// CacheStats returns the counters of the cache of parsed files.
+func (h *Htex) CacheStats() CacheStats {
+	h.cache.mutex.Lock()
+	defer h.cache.mutex.Unlock()
+	stats := h.cache.stats
+	stats.Entries = len(h.cache.entries)
+	return stats
+}
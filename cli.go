@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 type CLI struct {
@@ -34,6 +35,7 @@ func baseUsage(c *CLI) {
 	if c.EnableGen {
 		fmt.Fprintln(out, "  ", c.ExeName, "gen")
 	}
+	fmt.Fprintln(out, "  ", c.ExeName, "config")
 	fmt.Fprintln(out, "  ", c.ExeName, "help")
 }
 
@@ -49,17 +51,33 @@ func (c *CLI) Run(args []string) {
 	var verbose bool
 	c.flag.BoolVar(&verbose, "verbose", false, "verbose output")
 
-	var fullchain, privkey, root, output string
-	var port int
+	// Flags modify the options of the configuration file
+	cfg := DefaultConfig()
+	var configFn string
 	server := flag.NewFlagSet(c.ExeName+" server", flag.ExitOnError)
-	server.IntVar(&port, "port", 0, "port to listen (80 or 443 by default)")
-	server.StringVar(&fullchain, "fullchain", "", "TLS certificate")
-	server.StringVar(&privkey, "privkey", "", "private key for the TLS certificate")
-	server.StringVar(&root, "root", "", "root directory to serve content ('public' by default)")
+	server.StringVar(&configFn, "config", "", "configuration file (htex.toml or htex.json by default)")
+	server.IntVar(&cfg.Server.Port, "port", cfg.Server.Port, "port to listen (80 or 443 by default)")
+	server.StringVar(&cfg.Server.Fullchain, "fullchain", cfg.Server.Fullchain, "TLS certificate")
+	server.StringVar(&cfg.Server.Privkey, "privkey", cfg.Server.Privkey, "private key for the TLS certificate")
+	server.StringVar(&cfg.Root, "root", cfg.Root, "root directory to serve content")
+	server.BoolVar(&cfg.Server.NoCache, "nocache", cfg.Server.NoCache, "parse .htex files in each request (for development)")
+	server.BoolVar(&cfg.Server.Dev, "dev", cfg.Server.Dev, "reload the pages in the browser when files change")
+	server.BoolVar(&cfg.Exec.Disable, "noexec", cfg.Exec.Disable, "don't run commands of <!exec> elements")
+	server.TextVar(&cfg.Server.ReadTimeout, "read-timeout", cfg.Server.ReadTimeout, "max time to read a request (0 = no limit)")
+	server.TextVar(&cfg.Server.WriteTimeout, "write-timeout", cfg.Server.WriteTimeout, "max time to write a response (0 = no limit)")
+	server.TextVar(&cfg.Server.IdleTimeout, "idle-timeout", cfg.Server.IdleTimeout, "max time to wait the next request of a keep-alive connection (0 = no limit)")
+	server.IntVar(&cfg.Server.MaxHeaderBytes, "max-header-bytes", cfg.Server.MaxHeaderBytes, "max size of the request headers")
+	server.TextVar(&cfg.Server.ShutdownTimeout, "shutdown-timeout", cfg.Server.ShutdownTimeout, "max time to finish active requests on SIGINT/SIGTERM (0 = no limit)")
+	server.TextVar(&cfg.Server.MaxStream, "max-stream", cfg.Server.MaxStream, "max time to stream a page after <!flush> (0 = no limit)")
 
 	gen := flag.NewFlagSet(c.ExeName+" gen", flag.ExitOnError)
-	gen.StringVar(&root, "root", "", "source directory to scan")
-	gen.StringVar(&output, "output", "", "output of the generation")
+	gen.StringVar(&configFn, "config", "", "configuration file (htex.toml or htex.json by default)")
+	gen.StringVar(&cfg.Root, "root", cfg.Root, "source directory to scan")
+	gen.StringVar(&cfg.Gen.Output, "output", cfg.Gen.Output, "output of the generation")
+	gen.BoolVar(&cfg.Gen.Drafts, "drafts", cfg.Gen.Drafts, "generate markdown pages marked as drafts")
+
+	config := flag.NewFlagSet(c.ExeName+" config", flag.ExitOnError)
+	config.StringVar(&configFn, "config", "", "configuration file (htex.toml or htex.json by default)")
 
 	flag.NewFlagSet("help", flag.ExitOnError)
 
@@ -72,34 +90,61 @@ func (c *CLI) Run(args []string) {
 		return
 	}
 
+	// Parses the flags of the command and loads the configuration
+	// file (flags are parsed again to override the file options)
+	parseConfig := func(flags *flag.FlagSet) {
+		args := c.flag.Args()[1:]
+		flags.Parse(args)
+		if configFn == "" {
+			configFn = FindConfigFile(".")
+		}
+		if configFn != "" {
+			if err := LoadConfig(configFn, &cfg); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			flags.Parse(args)
+		}
+		cfg.Root, _ = filepath.Abs(cfg.Root)
+		cfg.Gen.Output, _ = filepath.Abs(cfg.Gen.Output)
+		if err := cfg.checkDirs(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
 	cmd := c.flag.Args()[0]
 	switch cmd {
 	case "server":
-		server.Parse(c.flag.Args()[1:])
-		if root != "" {
-			root, _ = filepath.Abs(root)
-		} else {
-			root, _ = filepath.Abs("public")
+		parseConfig(server)
+		h := NewHtex(cfg.Root, verbose)
+		h.ApplyConfig(&cfg)
+		if cfg.Server.Dev {
+			h.EnableLiveReload(500 * time.Millisecond)
+			h.Drafts = true
+		}
+		if err := h.RunWebServer(cfg.Server.Port, cfg.Server.Fullchain, cfg.Server.Privkey); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
 		}
-		h := NewHtex(root, verbose)
-		h.RunWebServer(port, fullchain, privkey)
 	case "gen":
 		if !c.EnableGen {
 			c.invalidArgExit(cmd)
 		}
-		gen.Parse(c.flag.Args()[1:])
-		if root != "" {
-			root, _ = filepath.Abs(root)
-		} else {
-			root, _ = filepath.Abs("public")
+		parseConfig(gen)
+		h := NewHtex(cfg.Root, verbose)
+		h.ApplyConfig(&cfg)
+		h.Drafts = cfg.Gen.Drafts
+		h.GenerateStaticContent(cfg.Gen.Output)
+	case "config":
+		parseConfig(config)
+		if configFn != "" {
+			fmt.Println("# Configuration file:", configFn)
 		}
-		if output != "" {
-			output, _ = filepath.Abs(output)
-		} else {
-			output, _ = filepath.Abs("output")
+		if err := WriteConfig(os.Stdout, &cfg); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
 		}
-		h := NewHtex(root, verbose)
-		h.GenerateStaticContent(output)
 	case "help":
 		if c.flag.NArg() >= 2 {
 			cmd := c.flag.Args()[1]
@@ -110,6 +155,8 @@ func (c *CLI) Run(args []string) {
 				if c.EnableGen {
 					gen.Usage()
 				}
+			case "config":
+				config.Usage()
 			default:
 				c.invalidArgExit(cmd)
 			}
@@ -0,0 +1,256 @@
+// Copyright (c) David Capello. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE.txt file.
+
+package htex
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Names of the configuration files searched in the current directory.
+var ConfigFileNames = []string{"htex.toml", "htex.json"}
+
+// Config contains the options of a project loaded from a htex.toml
+// or htex.json file.
+type Config struct {
+	Root      string          `toml:"root" json:"root"`           // Directory with the files of the site
+	Server    ServerOptions   `toml:"server" json:"server"`       // Options of "htex server"
+	Gen       GenOptions      `toml:"gen" json:"gen"`             // Options of "htex gen"
+	Vars      map[string]any  `toml:"vars" json:"vars,omitempty"` // Variables available in all pages
+	Redirects []RedirectRule  `toml:"redirects" json:"redirects,omitempty"`
+	Headers   []HeaderRule    `toml:"headers" json:"headers,omitempty"`
+	Exec      ExecPolicy      `toml:"exec" json:"exec"`
+	Upload    UploadPolicy    `toml:"upload" json:"upload"`
+	Markdown  MarkdownOptions `toml:"markdown" json:"markdown"`
+}
+
+// ServerOptions are the options of the web server in the
+// configuration file.
+type ServerOptions struct {
+	Port            int      `toml:"port" json:"port"` // 80 or 443 by default
+	Fullchain       string   `toml:"fullchain" json:"fullchain"`
+	Privkey         string   `toml:"privkey" json:"privkey"`
+	Dev             bool     `toml:"dev" json:"dev"` // Live reload and markdown drafts
+	NoCache         bool     `toml:"nocache" json:"nocache"`
+	ReadTimeout     Duration `toml:"read_timeout" json:"read_timeout"`
+	WriteTimeout    Duration `toml:"write_timeout" json:"write_timeout"`
+	IdleTimeout     Duration `toml:"idle_timeout" json:"idle_timeout"`
+	MaxHeaderBytes  int      `toml:"max_header_bytes" json:"max_header_bytes"`
+	ShutdownTimeout Duration `toml:"shutdown_timeout" json:"shutdown_timeout"`
+	MaxStream       Duration `toml:"max_stream" json:"max_stream"` // Max time to stream a page after <!flush>
+}
+
+// GenOptions are the options of the static generation in the
+// configuration file.
+type GenOptions struct {
+	Output string `toml:"output" json:"output"`
+	Drafts bool   `toml:"drafts" json:"drafts"` // Generate markdown drafts
+}
+
+// RedirectRule redirects requests of the From URL path to the To
+// URL. If From ends with "*", all paths starting with From are
+// redirected, and the "*" in To is replaced with the rest of the
+// path.
+type RedirectRule struct {
+	From string `toml:"from" json:"from"`
+	To   string `toml:"to" json:"to"`
+	Code int    `toml:"code,omitempty" json:"code,omitempty"` // 301 by default
+}
+
+// HeaderRule adds headers to the responses of the URL paths that
+// match Path (which can end with "*" to match a prefix).
+type HeaderRule struct {
+	Path   string            `toml:"path" json:"path"`
+	Values map[string]string `toml:"values" json:"values"`
+}
+
+// Duration is a time.Duration written as a string in configuration
+// files and flags (e.g. "30s" or "2m").
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	value, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(value)
+	return nil
+}
+
+// DefaultConfig returns the options used when there is no
+// configuration file.
+func DefaultConfig() Config {
+	return Config{
+		Root: "public",
+		Server: ServerOptions{
+			ReadTimeout:     Duration(DefaultServerConfig.ReadTimeout),
+			WriteTimeout:    Duration(DefaultServerConfig.WriteTimeout),
+			IdleTimeout:     Duration(DefaultServerConfig.IdleTimeout),
+			MaxHeaderBytes:  DefaultServerConfig.MaxHeaderBytes,
+			ShutdownTimeout: Duration(DefaultServerConfig.ShutdownTimeout),
+			MaxStream:       Duration(DefaultServerConfig.MaxStreamDuration),
+		},
+		Gen:      GenOptions{Output: "output"},
+		Exec:     DefaultExecPolicy,
+		Upload:   DefaultUploadPolicy,
+		Markdown: DefaultMarkdownOptions,
+	}
+}
+
+// FindConfigFile returns the configuration file in the given
+// directory, or an empty string if there is no configuration file.
+func FindConfigFile(dir string) string {
+	for _, name := range ConfigFileNames {
+		fn := filepath.Join(dir, name)
+		if s, err := os.Stat(fn); err == nil && s.Mode().IsRegular() {
+			return fn
+		}
+	}
+	return ""
+}
+
+// LoadConfig reads the given configuration file. Options that are
+// not in the file keep their current values in cfg. Relative paths
+// are converted to paths relative to the directory of the file.
+func LoadConfig(fn string, cfg *Config) error {
+	content, err := os.ReadFile(fn)
+	if err != nil {
+		return err
+	}
+	root := cfg.Root
+	cfg.Root = ""
+	switch strings.ToLower(filepath.Ext(fn)) {
+	case ".toml":
+		md, err := toml.Decode(string(content), cfg)
+		if err != nil {
+			return fmt.Errorf("%s: %w", fn, err)
+		}
+		for _, key := range md.Undecoded() {
+			// Variables can contain anything
+			if key[0] != "vars" {
+				return fmt.Errorf("%s: unknown option '%s'", fn, key)
+			}
+		}
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(content))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(cfg); err != nil {
+			return fmt.Errorf("%s: %w", fn, err)
+		}
+	default:
+		return fmt.Errorf("%s: unsupported configuration file format", fn)
+	}
+
+	dir := filepath.Dir(fn)
+	if cfg.Root == "" {
+		cfg.Root = root
+	} else if !filepath.IsAbs(cfg.Root) {
+		cfg.Root = filepath.Join(dir, cfg.Root)
+	}
+	if cfg.Gen.Output != "" && !filepath.IsAbs(cfg.Gen.Output) {
+		cfg.Gen.Output = filepath.Join(dir, cfg.Gen.Output)
+	}
+	if cfg.Exec.BinDir != "" && !filepath.IsAbs(cfg.Exec.BinDir) {
+		cfg.Exec.BinDir = filepath.Join(dir, cfg.Exec.BinDir)
+	}
+	if cfg.Upload.Dir != "" && !filepath.IsAbs(cfg.Upload.Dir) {
+		cfg.Upload.Dir = filepath.Join(dir, cfg.Upload.Dir)
+	}
+	if err := cfg.Markdown.validate(); err != nil {
+		return fmt.Errorf("%s: %w", fn, err)
+	}
+	for _, rule := range cfg.Redirects {
+		if rule.From == "" || rule.To == "" {
+			return fmt.Errorf("%s: redirects need 'from' and 'to' options", fn)
+		}
+		if rule.Code != 0 && (rule.Code < 300 || rule.Code > 399) {
+			return fmt.Errorf("%s: invalid redirect code %d", fn, rule.Code)
+		}
+	}
+	return nil
+}
+
+// checkDirs checks the directories of the configuration once the
+// options of the command line were applied (e.g. the upload
+// directory cannot be inside the root directory given with -root).
+func (cfg *Config) checkDirs() error {
+	if cfg.Upload.Dir != "" && isInsideDir(cfg.Upload.Dir, cfg.Root) {
+		return fmt.Errorf("the upload directory %s cannot be inside the root directory %s", cfg.Upload.Dir, cfg.Root)
+	}
+	return nil
+}
+
+// WriteConfig writes the given configuration in TOML format.
+func WriteConfig(w io.Writer, cfg *Config) error {
+	return toml.NewEncoder(w).Encode(cfg)
+}
+
+// ApplyConfig uses the options of the configuration file in the
+// server. Options of the command line (root, port, TLS, etc.) are
+// used by the CLI.
+func (h *Htex) ApplyConfig(cfg *Config) {
+	h.Server = ServerConfig{
+		ReadTimeout:     time.Duration(cfg.Server.ReadTimeout),
+		WriteTimeout:    time.Duration(cfg.Server.WriteTimeout),
+		IdleTimeout:     time.Duration(cfg.Server.IdleTimeout),
+		MaxHeaderBytes:  cfg.Server.MaxHeaderBytes,
+		ShutdownTimeout: time.Duration(cfg.Server.ShutdownTimeout),
+
+		MaxStreamDuration: time.Duration(cfg.Server.MaxStream),
+	}
+	h.DisableCache = cfg.Server.NoCache
+	h.Vars = normalizeData(cfg.Vars).(map[string]any)
+	h.Redirects = cfg.Redirects
+	h.Headers = cfg.Headers
+	h.Exec = cfg.Exec
+	h.Upload = cfg.Upload
+	h.Markdown = cfg.Markdown
+}
+
+// matchRulePath returns true if the URL path matches the path of a
+// rule, and the rest of the path if the rule ends with "*".
+func matchRulePath(pattern, urlPath string) (string, bool) {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.CutPrefix(urlPath, prefix)
+	}
+	return "", urlPath == path.Clean(pattern)
+}
+
+// applyRules adds the headers of the HeaderRules that match the given
+// URL path, and returns true if the request was redirected.
+func (h *Htex) applyRules(w http.ResponseWriter, r *http.Request, urlPath string) bool {
+	for _, rule := range h.Headers {
+		if _, ok := matchRulePath(rule.Path, urlPath); ok {
+			for name, value := range rule.Values {
+				w.Header().Set(name, value)
+			}
+		}
+	}
+	for _, rule := range h.Redirects {
+		if rest, ok := matchRulePath(rule.From, urlPath); ok {
+			code := rule.Code
+			if code == 0 {
+				code = http.StatusMovedPermanently
+			}
+			http.Redirect(w, r, strings.Replace(rule.To, "*", rest, 1), code)
+			return true
+		}
+	}
+	return false
+}
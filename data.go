@@ -0,0 +1,122 @@
+// Copyright (c) David Capello. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE.txt file.
+
+package htex
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// loadDataFile loads a structured data file (.json, .yaml, .yml,
+// .toml, or .csv) to be used as a variable in templates.
+func (h *Htex) loadDataFile(fn string) (any, error) {
+	content, err := h.readFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	return parseData(strings.ToLower(filepath.Ext(fn)), content)
+}
+
+// parseData parses the content of a data file depending on its
+// extension. The result is normalized so it only contains the types
+// that expressions can handle: strings, float64, bool, []any, and
+// map[string]any.
+func parseData(ext string, content []byte) (any, error) {
+	var data any
+	switch ext {
+	case ".json":
+		err := json.Unmarshal(content, &data)
+		if err != nil {
+			return nil, err
+		}
+	case ".yaml", ".yml":
+		err := yaml.Unmarshal(content, &data)
+		if err != nil {
+			return nil, err
+		}
+	case ".toml":
+		var m map[string]any
+		err := toml.Unmarshal(content, &m)
+		if err != nil {
+			return nil, err
+		}
+		data = m
+	case ".csv":
+		return parseCsv(content)
+	default:
+		return nil, fmt.Errorf("unsupported data file format '%s'", ext)
+	}
+	return normalizeData(data), nil
+}
+
+// parseCsv returns the records of a CSV file as a list of maps using
+// the first row as the names of the fields.
+func parseCsv(content []byte) (any, error) {
+	rows, err := csv.NewReader(bytes.NewReader(content)).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	records := []any{}
+	if len(rows) == 0 {
+		return records, nil
+	}
+	header := rows[0]
+	for _, row := range rows[1:] {
+		record := make(map[string]any)
+		for i, field := range header {
+			if i < len(row) {
+				record[field] = row[i]
+			}
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func normalizeData(data any) any {
+	switch v := data.(type) {
+	case map[string]any:
+		for key, value := range v {
+			v[key] = normalizeData(value)
+		}
+		return v
+	case map[any]any:
+		m := make(map[string]any, len(v))
+		for key, value := range v {
+			m[fmt.Sprint(key)] = normalizeData(value)
+		}
+		return m
+	case []any:
+		for i := range v {
+			v[i] = normalizeData(v[i])
+		}
+		return v
+	case []map[string]any:
+		items := make([]any, len(v))
+		for i := range v {
+			items[i] = normalizeData(v[i])
+		}
+		return items
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	case float32:
+		return float64(v)
+	case time.Time:
+		return v.Format(time.RFC3339)
+	}
+	return data
+}
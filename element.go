@@ -0,0 +1,113 @@
+// Copyright (c) David Capello. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE.txt file.
+
+package htex
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// ParseElementFunc parses the arguments of a custom element, i.e. the
+// text after the name of the element (e.g. "id=2" for <!user id=2>).
+// The returned value is given to the RenderElementFunc each time the
+// element is rendered. If an error is returned, the file cannot be
+// parsed.
+type ParseElementFunc func(args string) (any, error)
+
+// RenderElementFunc renders a custom element using the value
+// returned by its ParseElementFunc.
+type RenderElementFunc func(ctx *ElementContext, data any) error
+
+// customElement is an element registered with
+// Htex.RegisterElement() or Htex.RegisterBlockElement().
+type customElement struct {
+	parse  ParseElementFunc
+	render RenderElementFunc
+	block  bool // True if the element has content until <!end>
+}
+
+// Names of the built-in elements, which cannot be used by custom
+// elements.
+var builtinElements = []string{
+	"block", "call", "content", "content-type", "cookie", "data",
+	"data-file", "data-raw", "define", "else", "elseif", "end", "exec",
+	"exec-raw", "flush", "for", "get", "get-raw", "header", "if",
+	"include-escaped", "include-markdown", "include-raw", "layout",
+	"method", "query", "query-raw", "redirect", "set", "status",
+	"upload", "upload-save", "url", "wrap",
+}
+
+// ElementContext gives access to the response, the request, and the
+// variables of the file to the custom elements.
+type ElementContext struct {
+	Writer  http.ResponseWriter
+	Request *http.Request
+	sc      *scope
+	elem    *Elem
+	content func()
+}
+
+// RegisterElement adds a custom element that can be used in .htex
+// files, e.g. RegisterElement("user", ...) to use <!user>. Element
+// names are case-insensitive. It returns an error if the name is the
+// name of a built-in element or an element already registered, or if
+// a function is nil.
+func (h *Htex) RegisterElement(name string, parse ParseElementFunc, render RenderElementFunc) error {
+	return h.registerElement(name, &customElement{parse: parse, render: render})
+}
+
+// RegisterBlockElement adds a custom element with content, e.g.
+// <!feature-flag x>...<!end>, where the RenderElementFunc can
+// render the content with ElementContext.Content().
+func (h *Htex) RegisterBlockElement(name string, parse ParseElementFunc, render RenderElementFunc) error {
+	return h.registerElement(name, &customElement{parse: parse, render: render, block: true})
+}
+
+func (h *Htex) registerElement(name string, elem *customElement) error {
+	name = strings.ToLower(name)
+	if name == "" || strings.IndexFunc(name, func(r rune) bool {
+		return r > 0x7f || !isAlphaNum(byte(r))
+	}) >= 0 {
+		return fmt.Errorf("invalid element name '%s'", name)
+	}
+	if slices.Contains(builtinElements, name) {
+		return fmt.Errorf("cannot register built-in element <!%s>", name)
+	}
+	if _, ok := h.elements[name]; ok {
+		return fmt.Errorf("element <!%s> already registered", name)
+	}
+	if elem.parse == nil || elem.render == nil {
+		return fmt.Errorf("element <!%s> needs parse and render functions", name)
+	}
+	h.elements[name] = elem
+	return nil
+}
+
+// Get returns the value of the given variable.
+func (ctx *ElementContext) Get(name string) (any, bool) {
+	return ctx.sc.lookup(name)
+}
+
+// Set changes the value of the given variable. Values are converted
+// to the types used by expressions (e.g. int to float64).
+func (ctx *ElementContext) Set(name string, value any) {
+	ctx.sc.vars[name] = normalizeData(value)
+}
+
+// Print writes the given value escaped for the context where the
+// element is used (e.g. inside an HTML attribute).
+func (ctx *ElementContext) Print(value any) {
+	ctx.Writer.Write([]byte(ctx.elem.ctx.escape(value)))
+}
+
+// Content renders the content of a block element. It can be called
+// several times, or not called at all to skip the content.
+func (ctx *ElementContext) Content() {
+	if ctx.content != nil {
+		ctx.content()
+	}
+}
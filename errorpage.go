@@ -0,0 +1,104 @@
+// Copyright (c) David Capello. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE.txt file.
+
+package htex
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// isErrorPage returns true if the given file is a custom error page
+// (e.g. 404.htex, 500.htex, or error.htex), which are not served as
+// regular pages.
+func isErrorPage(fn string) bool {
+	base := filepath.Base(fn)
+	if base == "error.htex" {
+		return true
+	}
+	name, found := strings.CutSuffix(base, ".htex")
+	if !found || len(name) != 3 {
+		return false
+	}
+	for _, c := range name {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// findErrorPage returns the custom error page for the given status
+// code. It looks for a "<code>.htex" file walking up from the given
+// directory to the root directory, and then for a generic
+// "error.htex" file in the same way.
+func (h *Htex) findErrorPage(dir string, code int) string {
+	root := filepath.Clean(h.localRoot)
+	dir = filepath.Clean(dir)
+	if !strings.HasPrefix(dir, root) {
+		dir = root
+	}
+	for _, base := range []string{fmt.Sprint(code, ".htex"), "error.htex"} {
+		for d := dir; ; d = filepath.Dir(d) {
+			fn := filepath.Join(d, base)
+			if h.isRegularFile(fn) {
+				return fn
+			}
+			if d == root || len(d) < len(root) {
+				break
+			}
+		}
+	}
+	return ""
+}
+
+// writeError responds with the given status code using the closest
+// custom error page to the given directory. The page can access the
+// "status", "statusText", and "error" variables. If there is no
+// error page (or it cannot be rendered), a plain text message is
+// used.
+func (h *Htex) writeError(w http.ResponseWriter, r *http.Request, sc *scope, dir string, code int, err error) {
+	if sc == nil || sc.status == 0 {
+		fn := h.findErrorPage(dir, code)
+		if fn != "" {
+			if h.verbose {
+				log.Println(" -> error page", fn)
+			}
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			hf, perr := h.parseHtexFile(w, r, fn)
+			if perr == nil {
+				esc := h.newPageScope(r)
+				esc.layouts = []string{hf.fn}
+				esc.status = code
+				esc.vars["status"] = float64(code)
+				esc.vars["statusText"] = http.StatusText(code)
+				if err != nil {
+					esc.vars["error"] = err.Error()
+				} else {
+					esc.vars["error"] = ""
+				}
+				rb := newResponseBuffer(w)
+				rb.WriteHeader(code)
+				r, stop := rb.streamFor(r, h.Server.MaxStreamDuration)
+				defer stop()
+				h.writeHtexFile0(rb, r, hf, nil, true, esc)
+				h.injectLiveReload(rb)
+				rb.commit()
+				return
+			}
+			log.Println(perr)
+		}
+	}
+	switch code {
+	case http.StatusNotFound:
+		http.NotFound(w, r)
+	case http.StatusInternalServerError:
+		http.Error(w, "500 internal error", code)
+	default:
+		http.Error(w, fmt.Sprint(code, " ", http.StatusText(code)), code)
+	}
+}
@@ -0,0 +1,433 @@
+// Copyright (c) David Capello. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE.txt file.
+
+package htex
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+// htmlState is the state of the HTML scanner used to know the
+// context where a value is printed (HTML text, an attribute, a
+// <script>, etc.)
+type htmlState uint8
+
+const (
+	stateText          htmlState = iota // HTML text
+	stateTagName                        // Name of a tag, e.g. "<a"
+	stateTag                            // Inside a tag, between attributes
+	stateAttrName                       // Name of an attribute
+	stateAfterAttrName                  // After the name of an attribute
+	stateBeforeValue                    // After the "=" of an attribute
+	stateAttrValue                      // Value of an attribute
+	stateComment                        // Inside <!-- ... -->
+	stateScript                         // Inside <script> or a JSON/JavaScript file
+	stateStyle                          // Inside <style> or a CSS file
+	stateRaw                            // Content that doesn't need escaping (e.g. text/plain)
+)
+
+type attrKind uint8
+
+const (
+	attrNormal attrKind = iota
+	attrURL             // e.g. href="..." or src="..."
+	attrScript          // e.g. onclick="..."
+	attrStyle           // style="..."
+)
+
+type urlPart uint8
+
+const (
+	urlStart urlPart = iota // Beginning of the URL (where the scheme is)
+	urlPath                 // Path of the URL
+	urlQuery                // After "?" or "#"
+)
+
+// htmlContext is the context where a value (e.g. <!get>, <!data>,
+// <!query>, or <!url>) is printed. It's calculated when the file
+// is parsed, feeding the text of the file (in order) to an HTML
+// scanner, so conditional branches are expected to leave the HTML
+// in the same state.
+type htmlContext struct {
+	state     htmlState
+	tag       string // Name of the current tag (lower case)
+	closing   bool   // True if the tag is a closing tag (e.g. "</a>")
+	name      string // Name of the tag or attribute being scanned
+	attr      attrKind
+	quote     byte // Quote of the attribute value (0 if it's unquoted)
+	url       urlPart
+	jsQuote   byte // Quote of the JavaScript string (0 if it's outside a string)
+	jsEscaped bool // True after a backslash inside a JavaScript string
+}
+
+func isNameChar(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+		(c >= '0' && c <= '9') || c == '-' || c == '_' || c == ':'
+}
+
+func isHtmlSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+func hasPrefixFold(s, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
+
+// setContentType changes the context depending on the type of
+// content of the file (e.g. JSON files use JavaScript escaping).
+func (c *htmlContext) setContentType(contentType string) {
+	*c = htmlContext{}
+	switch {
+	case strings.Contains(contentType, "html") ||
+		strings.Contains(contentType, "xml"):
+		c.state = stateText
+	case strings.Contains(contentType, "json") ||
+		strings.Contains(contentType, "javascript"):
+		c.state = stateScript
+	case strings.Contains(contentType, "css"):
+		c.state = stateStyle
+	default:
+		c.state = stateRaw
+	}
+}
+
+func (c *htmlContext) endTag() {
+	c.state = stateText
+	if !c.closing {
+		switch c.tag {
+		case "script":
+			c.state = stateScript
+			c.jsQuote = 0
+		case "style":
+			c.state = stateStyle
+		}
+	}
+}
+
+func (c *htmlContext) endAttrName() {
+	c.attr = attrNormal
+	switch {
+	case strings.HasPrefix(c.name, "on"):
+		c.attr = attrScript
+	case c.name == "style":
+		c.attr = attrStyle
+	case c.name == "href" || c.name == "src" || c.name == "action" ||
+		c.name == "formaction" || c.name == "cite" || c.name == "data" ||
+		c.name == "poster" || c.name == "background" ||
+		c.name == "srcset" || c.name == "manifest" || c.name == "icon" ||
+		c.name == "longdesc" || c.name == "usemap" || c.name == "codebase" ||
+		strings.Contains(c.name, "url") || strings.Contains(c.name, "uri"):
+		c.attr = attrURL
+	}
+}
+
+func (c *htmlContext) beginAttrValue(quote byte) {
+	c.state = stateAttrValue
+	c.quote = quote
+	c.url = urlStart
+	c.jsQuote = 0
+	c.jsEscaped = false
+}
+
+func (c *htmlContext) feedJS(ch byte) {
+	if c.jsEscaped {
+		c.jsEscaped = false
+	} else if c.jsQuote != 0 {
+		if ch == '\\' {
+			c.jsEscaped = true
+		} else if ch == c.jsQuote {
+			c.jsQuote = 0
+		}
+	} else if ch == '"' || ch == '\'' || ch == '`' {
+		c.jsQuote = ch
+	}
+}
+
+// feed updates the context with the given text of the file.
+func (c *htmlContext) feed(text string) {
+	for i := 0; i < len(text); i++ {
+		ch := text[i]
+		switch c.state {
+		case stateText:
+			if strings.HasPrefix(text[i:], "<!--") {
+				c.state = stateComment
+				i += 3
+			} else if ch == '<' && i+1 < len(text) &&
+				(isNameChar(text[i+1]) || text[i+1] == '/' || text[i+1] == '!') {
+				c.state = stateTagName
+				c.name = ""
+				c.closing = false
+			}
+		case stateTagName:
+			if ch == '/' && c.name == "" {
+				c.closing = true
+			} else if isNameChar(ch) {
+				c.name += strings.ToLower(string(ch))
+			} else {
+				c.tag = c.name
+				c.state = stateTag
+				i-- // Process the same char in stateTag
+			}
+		case stateTag:
+			if ch == '>' {
+				c.endTag()
+			} else if !isHtmlSpace(ch) && ch != '/' {
+				c.state = stateAttrName
+				c.name = strings.ToLower(string(ch))
+			}
+		case stateAttrName:
+			if isHtmlSpace(ch) {
+				c.endAttrName()
+				c.state = stateAfterAttrName
+			} else if ch == '=' {
+				c.endAttrName()
+				c.state = stateBeforeValue
+			} else if ch == '>' {
+				c.endTag()
+			} else if ch == '/' {
+				c.state = stateTag
+			} else {
+				c.name += strings.ToLower(string(ch))
+			}
+		case stateAfterAttrName:
+			if ch == '=' {
+				c.state = stateBeforeValue
+			} else if ch == '>' {
+				c.endTag()
+			} else if !isHtmlSpace(ch) {
+				c.state = stateAttrName
+				c.name = strings.ToLower(string(ch))
+			}
+		case stateBeforeValue:
+			if ch == '"' || ch == '\'' {
+				c.beginAttrValue(ch)
+			} else if ch == '>' {
+				c.endTag()
+			} else if !isHtmlSpace(ch) {
+				c.beginAttrValue(0)
+				i-- // Process the same char in stateAttrValue
+			}
+		case stateAttrValue:
+			if c.quote != 0 && ch == c.quote {
+				c.state = stateTag
+			} else if c.quote == 0 && isHtmlSpace(ch) {
+				c.state = stateTag
+			} else if c.quote == 0 && ch == '>' {
+				c.endTag()
+			} else {
+				if ch == '?' || ch == '#' {
+					c.url = urlQuery
+				} else if c.url == urlStart {
+					c.url = urlPath
+				}
+				if c.attr == attrScript {
+					c.feedJS(ch)
+				}
+			}
+		case stateComment:
+			if strings.HasPrefix(text[i:], "-->") {
+				c.state = stateText
+				i += 2
+			}
+		case stateScript:
+			if ch == '<' && c.tag == "script" && hasPrefixFold(text[i:], "</script") {
+				c.state = stateTagName
+				c.name = ""
+				c.closing = false
+			} else {
+				c.feedJS(ch)
+			}
+		case stateStyle:
+			if ch == '<' && c.tag == "style" && hasPrefixFold(text[i:], "</style") {
+				c.state = stateTagName
+				c.name = ""
+				c.closing = false
+			}
+		}
+	}
+}
+
+// feedValue updates the context after a value is printed.
+func (c *htmlContext) feedValue() {
+	switch c.state {
+	case stateBeforeValue:
+		c.beginAttrValue(0)
+		c.url = urlPath
+	case stateAttrValue:
+		if c.url == urlStart {
+			c.url = urlPath
+		}
+	}
+}
+
+// escape converts the given value to a string that can be printed
+// safely in this context.
+func (c *htmlContext) escape(value any) string {
+	if v, ok := value.(rawValue); ok {
+		return string(v)
+	}
+	if v, ok := value.(escapedValue); ok {
+		if c.state == stateText {
+			return string(v)
+		}
+		value = html.UnescapeString(string(v))
+	}
+	switch c.state {
+	case stateRaw:
+		return toString(value)
+	case stateScript:
+		return escapeJS(c.jsQuote, value)
+	case stateStyle:
+		return escapeCSS(toString(value))
+	case stateTagName, stateTag, stateAttrName, stateAfterAttrName:
+		return filterName(toString(value))
+	case stateBeforeValue, stateAttrValue:
+		var s string
+		switch c.attr {
+		case attrURL:
+			s = escapeURL(c.url, toString(value))
+		case attrScript:
+			s = escapeJS(c.jsQuote, value)
+		case attrStyle:
+			s = escapeCSS(toString(value))
+		default:
+			s = toString(value)
+		}
+		if c.state == stateBeforeValue || c.quote == 0 {
+			return unquotedAttrReplacer.Replace(s)
+		}
+		return html.EscapeString(s)
+	}
+	return html.EscapeString(toString(value))
+}
+
+// Value used to replace unsafe values (e.g. a "javascript:" URL)
+const unsafeValue = "ZhtexZ"
+
+var unquotedAttrReplacer = strings.NewReplacer(
+	"&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&#34;", "'", "&#39;",
+	"=", "&#61;", "`", "&#96;", " ", "&#32;", "\t", "&#9;",
+	"\n", "&#10;", "\r", "&#13;", "\f", "&#12;")
+
+// filterName returns the given string if it can be used as the name
+// of a tag or attribute.
+func filterName(s string) string {
+	if s == "" {
+		return s
+	}
+	for i := 0; i < len(s); i++ {
+		if !isNameChar(s[i]) {
+			return unsafeValue
+		}
+	}
+	return s
+}
+
+// escapeJS returns the given value as a JavaScript value, or as the
+// content of a JavaScript string if quote is not 0. The result is
+// valid JSON too.
+func escapeJS(quote byte, value any) string {
+	if quote != 0 {
+		return escapeJSString(toString(value))
+	}
+	if v, ok := value.(jsonValue); ok {
+		return escapeJSString(string(v), '"')
+	}
+	result, err := json.Marshal(value)
+	if err != nil {
+		return "null"
+	}
+	return escapeJSString(string(result), '"')
+}
+
+// escapeJSString escapes the content of a JavaScript string. Chars
+// in keep are not escaped.
+func escapeJSString(s string, keep ...byte) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r < utf8.RuneSelf && len(keep) > 0 && byte(r) == keep[0]:
+			b.WriteRune(r)
+		case r == '\\' && len(keep) == 0:
+			b.WriteString(`\\`)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r < ' ' || r == '"' || r == '\'' || r == '`' || r == '$' ||
+			r == '<' || r == '>' || r == '&' ||
+			r == '\u2028' || r == '\u2029':
+			fmt.Fprintf(&b, `\u%04x`, r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// escapeCSS escapes the given string to be used as a CSS value.
+func escapeCSS(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') ||
+			(r >= '0' && r <= '9') || r >= utf8.RuneSelf ||
+			strings.ContainsRune(" #.,%-_+", r) {
+			b.WriteRune(r)
+		} else {
+			fmt.Fprintf(&b, `\%x `, r)
+		}
+	}
+	return b.String()
+}
+
+// escapeURL escapes the given string to be used in a part of a URL.
+// At the beginning of the URL only safe schemes are allowed.
+func escapeURL(part urlPart, s string) string {
+	if part == urlQuery {
+		return url.QueryEscape(s)
+	}
+	if part == urlStart {
+		if scheme, _, found := strings.Cut(s, ":"); found &&
+			!strings.ContainsAny(scheme, "/?#") {
+			switch strings.ToLower(scheme) {
+			case "http", "https", "mailto", "tel":
+			default:
+				return "#" + unsafeValue
+			}
+		}
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if ch <= ' ' || ch >= 0x7f || strings.IndexByte("\"'<>\\^`{|}", ch) >= 0 {
+			fmt.Fprintf(&b, "%%%02X", ch)
+		} else {
+			b.WriteByte(ch)
+		}
+	}
+	return b.String()
+}
+
+// escapeWriter escapes the HTML special characters of the text
+// written in it (e.g. the output of <!exec> or <!include-escaped>).
+// The text can be written in chunks because each special character
+// is one byte.
+type escapeWriter struct {
+	w io.Writer
+}
+
+func (e *escapeWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(e.w, html.EscapeString(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,480 @@
+// Copyright (c) David Capello. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE.txt file.
+
+package htex
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ExecPolicy controls which commands <!exec> elements can run and
+// their limits. If Allow and BinDir are empty, any command can be
+// executed.
+type ExecPolicy struct {
+	Disable     bool                `toml:"disable" json:"disable"`                       // Don't run commands at all
+	Allow       []string            `toml:"allow,omitempty" json:"allow,omitempty"`       // Names of the commands that can be executed
+	BinDir      string              `toml:"bin_dir,omitempty" json:"bin_dir,omitempty"`   // Only commands of this directory can be executed
+	Timeout     Duration            `toml:"timeout" json:"timeout"`                       // Max time to run a command (0 = no limit)
+	Timeouts    map[string]Duration `toml:"timeouts,omitempty" json:"timeouts,omitempty"` // Max time to run specific commands
+	MaxOutput   int                 `toml:"max_output" json:"max_output"`                 // Max size of the output in bytes (0 = no limit)
+	Env         []string            `toml:"env,omitempty" json:"env,omitempty"`           // Environment variables passed to the commands (besides PATH)
+	Stdin       bool                `toml:"stdin" json:"stdin"`                           // Pass the body of the request to the commands
+	MaxStdin    int                 `toml:"max_stdin" json:"max_stdin"`                   // Max size of the body passed to the commands (0 = no limit)
+	Placeholder string              `toml:"placeholder" json:"placeholder"`               // Printed when a command fails ("{error}" is replaced with the error)
+}
+
+var DefaultExecPolicy = ExecPolicy{
+	Timeout:     Duration(10 * time.Second),
+	MaxOutput:   1 << 20,
+	MaxStdin:    1 << 20,
+	Placeholder: "<!-- exec error -->",
+}
+
+// Time to wait the output of a command after it's killed.
+const execWaitDelay = time.Second
+
+// limitedWriter writes the output of a command and stops the command
+// when the output is too big.
+type limitedWriter struct {
+	w        io.Writer
+	n        int
+	max      int
+	exceeded bool
+	cancel   context.CancelFunc
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if l.exceeded {
+		return len(p), nil
+	}
+	if l.max > 0 && l.n+len(p) > l.max {
+		l.exceeded = true
+		l.cancel()
+		return len(p), nil
+	}
+	l.n += len(p)
+	return l.w.Write(p)
+}
+
+// flushWriter sends each write to the client immediately.
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	http.NewResponseController(f.w).Flush()
+	return n, err
+}
+
+// commandPath returns the program to run for the given command name
+// depending on the policy.
+func (policy *ExecPolicy) commandPath(name string) (string, error) {
+	if policy.BinDir != "" {
+		if strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+			return "", fmt.Errorf("command '%s' is not in %s", name, policy.BinDir)
+		}
+		fn := filepath.Join(policy.BinDir, name)
+		if s, err := os.Stat(fn); err != nil || !s.Mode().IsRegular() {
+			return "", fmt.Errorf("command '%s' is not in %s", name, policy.BinDir)
+		}
+		return fn, nil
+	}
+	if len(policy.Allow) > 0 && !slices.Contains(policy.Allow, name) {
+		return "", fmt.Errorf("command '%s' is not allowed", name)
+	}
+	return name, nil
+}
+
+// environ returns the environment variables of the commands.
+func (policy *ExecPolicy) environ() []string {
+	env := []string{"PATH=" + os.Getenv("PATH")}
+	for _, name := range policy.Env {
+		if value, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+value)
+		}
+	}
+	return env
+}
+
+// envName converts a header or field name to the name of an
+// environment variable (e.g. "Content-Type" to "CONTENT_TYPE").
+func envName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		} else if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// requestEnv returns the CGI variables (RFC 3875) and the HTEX_*
+// variables with the information of the request for the commands.
+func requestEnv(r *http.Request) []string {
+	var env []string
+	add := func(name, value string) {
+		env = append(env, name+"="+value)
+	}
+	host, port, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	remoteAddr, remotePort, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteAddr = r.RemoteAddr
+	}
+
+	add("GATEWAY_INTERFACE", "CGI/1.1")
+	add("SERVER_SOFTWARE", "htex")
+	add("SERVER_PROTOCOL", r.Proto)
+	add("SERVER_NAME", host)
+	add("SERVER_PORT", port)
+	add("REQUEST_METHOD", r.Method)
+	add("REQUEST_URI", r.URL.RequestURI())
+	add("SCRIPT_NAME", r.URL.Path)
+	add("QUERY_STRING", r.URL.RawQuery)
+	add("REMOTE_ADDR", remoteAddr)
+	add("REMOTE_PORT", remotePort)
+	add("CONTENT_TYPE", r.Header.Get("Content-Type"))
+	if r.ContentLength > 0 {
+		add("CONTENT_LENGTH", strconv.FormatInt(r.ContentLength, 10))
+	}
+	if r.TLS != nil {
+		add("HTTPS", "on")
+	}
+	for name, values := range r.Header {
+		name = envName(name)
+		// Skip "Proxy" header to avoid httpoxy attacks
+		if name == "PROXY" || name == "CONTENT_TYPE" || name == "CONTENT_LENGTH" {
+			continue
+		}
+		add("HTTP_"+name, strings.Join(values, ", "))
+	}
+
+	add("HTEX_METHOD", r.Method)
+	add("HTEX_PATH", r.URL.Path)
+	add("HTEX_QUERY", r.URL.RawQuery)
+	add("HTEX_REMOTE_ADDR", remoteAddr)
+	for name, values := range r.URL.Query() {
+		add("HTEX_QUERY_"+envName(name), values[0])
+	}
+	for name, values := range r.PostForm {
+		if len(values) > 0 {
+			add("HTEX_FORM_"+envName(name), values[0])
+		}
+	}
+	return env
+}
+
+// requestBody returns the body of the request to pass it to the
+// commands. The body is kept in memory so several commands can read
+// it. Forms already parsed with ParseForm() are encoded again.
+func requestBody(r *http.Request, maxSize int) ([]byte, error) {
+	if len(r.PostForm) > 0 &&
+		strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		return []byte(r.PostForm.Encode()), nil
+	}
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+	var reader io.Reader = r.Body
+	if maxSize > 0 {
+		reader = io.LimitReader(r.Body, int64(maxSize)+1)
+	}
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if maxSize > 0 && len(body) > maxSize {
+		return nil, fmt.Errorf("request body exceeds %d bytes", maxSize)
+	}
+	return body, nil
+}
+
+// runCommand executes the command of an <!exec> element following
+// the exec policy of the server, and writes its output in out.
+func (h *Htex) runCommand(r *http.Request, args []string, out io.Writer) error {
+	policy := &h.Exec
+	if policy.Disable {
+		return errors.New("<!exec> is disabled")
+	}
+	name, err := policy.commandPath(args[0])
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	timeout := policy.Timeout
+	if t, ok := policy.Timeouts[args[0]]; ok {
+		timeout = t
+	}
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(timeout))
+		defer cancel()
+	}
+
+	stdout := &limitedWriter{w: out, max: policy.MaxOutput, cancel: cancel}
+	cmd := exec.CommandContext(ctx, name, args[1:]...)
+	cmd.Dir = h.execDir
+	cmd.Env = append(policy.environ(), requestEnv(r)...)
+	cmd.Stdout = stdout
+	// Don't wait child processes that keep the output open after the
+	// command is killed
+	cmd.WaitDelay = execWaitDelay
+	setProcessGroup(cmd)
+	if policy.Stdin {
+		body, err := requestBody(r, policy.MaxStdin)
+		if err != nil {
+			return err
+		}
+		cmd.Stdin = bytes.NewReader(body)
+	}
+	err = cmd.Run()
+	if stdout.exceeded {
+		return fmt.Errorf("output of '%s' exceeds %d bytes", args[0], policy.MaxOutput)
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("'%s' timed out after %v", args[0], time.Duration(timeout))
+	}
+	if err != nil {
+		return fmt.Errorf("'%s' failed: %w", args[0], err)
+	}
+	return nil
+}
+
+// writeCommand runs the command of an <!exec> element and prints its
+// output. If the page is being streamed (after <!flush>), the output
+// is sent to the client while the command runs, in other case the
+// output is printed only if the command succeeds. The placeholder is
+// printed when the command fails.
+func (h *Htex) writeCommand(w http.ResponseWriter, r *http.Request, elem *Elem, args []string) {
+	var buf bytes.Buffer
+	var out io.Writer = &buf
+	if isStreaming(w) {
+		out = &flushWriter{w: w}
+	}
+	if !elem.raw {
+		out = &escapeWriter{w: out}
+	}
+	if err := h.runCommand(r, args, out); err != nil {
+		log.Println(elem.pos, err)
+		w.Write([]byte(h.execPlaceholder(err)))
+		return
+	}
+	w.Write(buf.Bytes())
+}
+
+// execPlaceholder returns the text printed when a command fails.
+func (h *Htex) execPlaceholder(err error) string {
+	return strings.ReplaceAll(h.Exec.Placeholder, "{error}", html.EscapeString(err.Error()))
+}
+
+// execPart is a literal text or a variable of an <!exec> argument.
+type execPart struct {
+	text  string
+	isVar bool // True if text is the name of a variable
+}
+
+// execArg is an argument of an <!exec> command, a sequence of
+// literal texts and variables (e.g. "--user=$name").
+type execArg []execPart
+
+// parseCommand splits the command of an <!exec> element in arguments
+// using shell-like quoting rules (without using a shell):
+//
+//   - 'text' is used as it is.
+//   - "text" can contain variables and \" \\ \$ escape sequences.
+//   - \c outside quotes is the c character.
+//   - $name and ${name} are replaced with the value of the variable
+//     (or a query/form value with ${query.key} and ${form.key}).
+//
+// Each argument is passed to the command as one argv entry, even if
+// the value of a variable contains spaces or quotes.
+func parseCommand(text string) ([]execArg, error) {
+	var args []execArg
+	var arg execArg
+	var lit strings.Builder
+	inArg := false
+	flushLit := func() {
+		if lit.Len() > 0 {
+			arg = append(arg, execPart{text: lit.String()})
+			lit.Reset()
+		}
+	}
+	// parseVar parses a variable after "$" and returns the number of
+	// read bytes (or 0 if it's not a variable).
+	parseVar := func(s string) (int, error) {
+		var name string
+		n := 0
+		if strings.HasPrefix(s, "{") {
+			end := strings.IndexByte(s, '}')
+			if end < 0 {
+				return 0, errors.New("variable not closed with '}'")
+			}
+			name = s[1:end]
+			n = end + 1
+			if !isVarName(name) {
+				return 0, fmt.Errorf("invalid variable name '%s'", name)
+			}
+		} else {
+			for n < len(s) && isVarChar(s[n], n == 0) {
+				n++
+			}
+			name = s[:n]
+		}
+		if n > 0 {
+			flushLit()
+			arg = append(arg, execPart{text: name, isVar: true})
+		}
+		return n, nil
+	}
+
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			if inArg {
+				flushLit()
+				args = append(args, arg)
+				arg = nil
+				inArg = false
+			}
+			continue
+		case c == '\'':
+			end := strings.IndexByte(text[i+1:], '\'')
+			if end < 0 {
+				return nil, errors.New("quote ' not closed")
+			}
+			lit.WriteString(text[i+1 : i+1+end])
+			if end == 0 {
+				// Empty argument ''
+				arg = append(arg, execPart{})
+			}
+			i += end + 1
+		case c == '"':
+			closed := false
+			if i+1 < len(text) && text[i+1] == '"' {
+				// Empty argument ""
+				arg = append(arg, execPart{})
+			}
+			for i++; i < len(text); i++ {
+				c = text[i]
+				if c == '"' {
+					closed = true
+					break
+				} else if c == '\\' && i+1 < len(text) && strings.IndexByte(`"\$`, text[i+1]) >= 0 {
+					i++
+					lit.WriteByte(text[i])
+				} else if c == '$' {
+					n, err := parseVar(text[i+1:])
+					if err != nil {
+						return nil, err
+					}
+					if n == 0 {
+						lit.WriteByte(c)
+					}
+					i += n
+				} else {
+					lit.WriteByte(c)
+				}
+			}
+			if !closed {
+				return nil, errors.New(`quote " not closed`)
+			}
+		case c == '\\' && i+1 < len(text):
+			i++
+			lit.WriteByte(text[i])
+		case c == '$':
+			n, err := parseVar(text[i+1:])
+			if err != nil {
+				return nil, err
+			}
+			if n == 0 {
+				lit.WriteByte(c)
+			}
+			i += n
+		default:
+			lit.WriteByte(c)
+		}
+		inArg = true
+	}
+	if inArg {
+		flushLit()
+		args = append(args, arg)
+	}
+
+	if len(args) == 0 {
+		return nil, errors.New("empty command")
+	}
+	for _, part := range args[0] {
+		if part.isVar {
+			return nil, errors.New("the command name cannot contain variables")
+		}
+	}
+	return args, nil
+}
+
+func isVarChar(c byte, first bool) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+		(!first && (c >= '0' && c <= '9'))
+}
+
+// isVarName returns true if the name is a valid variable name for
+// ${name}, which can be a dotted path (e.g. "user.name").
+func isVarName(name string) bool {
+	for _, field := range strings.Split(name, ".") {
+		if field == "" {
+			return false
+		}
+		for i := 0; i < len(field); i++ {
+			if !isVarChar(field[i], i == 0) && field[i] != '-' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// eval returns the value of the argument with the values of its
+// variables.
+func (arg execArg) eval(sc *scope) string {
+	var b strings.Builder
+	for _, part := range arg {
+		if !part.isVar {
+			b.WriteString(part.text)
+		} else if value, ok := sc.lookup(part.text); ok {
+			b.WriteString(toString(value))
+		} else if key, ok := strings.CutPrefix(part.text, "query."); ok {
+			b.WriteString(sc.query.Get(key))
+		} else if key, ok := strings.CutPrefix(part.text, "form."); ok && sc.r != nil {
+			b.WriteString(sc.r.Form.Get(key))
+		} else if field, ok := strings.CutPrefix(part.text, "upload."); ok && sc.r != nil {
+			fn, err := uploadPath(sc.r, field)
+			if err != nil {
+				log.Println("cannot pass the uploaded file to the command:", err)
+			}
+			b.WriteString(fn)
+		}
+	}
+	return b.String()
+}
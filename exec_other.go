@@ -0,0 +1,14 @@
+// Copyright (c) David Capello. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE.txt file.
+
+//go:build !unix
+
+package htex
+
+import "os/exec"
+
+// setProcessGroup does nothing in systems without process groups
+// (the cmd.WaitDelay is used to stop waiting the child processes).
+func setProcessGroup(cmd *exec.Cmd) {
+}
@@ -0,0 +1,630 @@
+// Copyright (c) David Capello. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE.txt file.
+
+package htex
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// scope contains the state that expressions can access when they
+// are evaluated: variables defined with <!set> or <!for> and the
+// current HTTP request (query keys and form fields). The same scope
+// is shared by a page and its layouts, and each component has its
+// own scope.
+type scope struct {
+	r      *http.Request
+	query  url.Values
+	vars   map[string]any
+	depth  int    // Number of nested components
+	calls  *calls // Components rendered in the request (shared by its scopes)
+	blocks blocks // Blocks that replace the blocks of the layouts
+	status int    // Status code when an error page is rendered
+
+	// Files of the page and its layouts (to detect cycles)
+	layouts []string
+
+	// File that set each top-level variable of the page and its
+	// layouts (inner files have precedence over their layouts)
+	varFiles map[string]*HtexFile
+}
+
+func newScope(r *http.Request) *scope {
+	return &scope{
+		r:        r,
+		query:    r.URL.Query(),
+		vars:     make(map[string]any),
+		blocks:   make(blocks),
+		calls:    &calls{},
+		varFiles: make(map[string]*HtexFile),
+	}
+}
+
+// canSetVar returns true if the given file can set the variable,
+// i.e. the variable wasn't set by an inner file (e.g. a layout cannot
+// replace the title set by its page).
+func (s *scope) canSetVar(hf *HtexFile, name string) bool {
+	f, ok := s.varFiles[name]
+	return !ok || f == hf
+}
+
+// lookup returns the value of the given variable, which can be a
+// dotted path to access fields of a value (e.g. "loop.index").
+func (s *scope) lookup(name string) (any, bool) {
+	if value, exist := s.vars[name]; exist {
+		return value, true
+	}
+	head, rest, found := strings.Cut(name, ".")
+	if !found {
+		return nil, false
+	}
+	value, exist := s.vars[head]
+	if !exist {
+		return nil, false
+	}
+	return lookupPath(value, rest)
+}
+
+func lookupPath(value any, path string) (any, bool) {
+	for _, field := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case map[string]any:
+			var exist bool
+			value, exist = v[field]
+			if !exist {
+				return nil, false
+			}
+		case []any:
+			i, err := strconv.Atoi(field)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			value = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// values returns the given values as a string if there is only one
+// value, or as a list in other case.
+func values(vs []string) any {
+	if len(vs) == 1 {
+		return vs[0]
+	}
+	return toList(vs)
+}
+
+//////////////////////////////////////////////////////////////////////
+// Expression tree
+
+type expr interface {
+	eval(s *scope) (any, error)
+}
+
+type exprLiteral struct {
+	value any
+}
+
+type exprVar struct {
+	name string
+}
+
+type exprCall struct {
+	fn  string
+	arg expr
+}
+
+type exprUnary struct {
+	op string
+	x  expr
+}
+
+type exprBinary struct {
+	op   string
+	x, y expr
+}
+
+type exprRange struct {
+	from, to expr
+}
+
+// Maximum number of items that a range can generate.
+const maxRangeLength = 100000
+
+func (e *exprLiteral) eval(s *scope) (any, error) {
+	return e.value, nil
+}
+
+func (e *exprVar) eval(s *scope) (any, error) {
+	if value, exist := s.lookup(e.name); exist {
+		return value, nil
+	}
+	return "", nil
+}
+
+func (e *exprCall) eval(s *scope) (any, error) {
+	arg, err := e.arg.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	key := toString(arg)
+
+	switch e.fn {
+	case "query":
+		if s.query.Has(key) {
+			return values(s.query[key]), nil
+		}
+		return "", nil
+	case "data":
+		if s.r.Form != nil && s.r.Form.Has(key) {
+			return values(s.r.Form[key]), nil
+		}
+		return "", nil
+	case "get":
+		return (&exprVar{key}).eval(s)
+	}
+	return nil, fmt.Errorf("unknown function %s()", e.fn)
+}
+
+func (e *exprUnary) eval(s *scope) (any, error) {
+	x, err := e.x.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	switch e.op {
+	case "!":
+		return !isTrue(x), nil
+	case "-":
+		n, ok := toNumber(x)
+		if !ok {
+			return nil, fmt.Errorf("cannot negate non-numeric value %q", toString(x))
+		}
+		return -n, nil
+	}
+	return nil, fmt.Errorf("unknown unary operator %s", e.op)
+}
+
+func (e *exprBinary) eval(s *scope) (any, error) {
+	x, err := e.x.eval(s)
+	if err != nil {
+		return nil, err
+	}
+
+	// Short-circuit evaluation of logical operators
+	if e.op == "&&" {
+		if !isTrue(x) {
+			return false, nil
+		}
+		y, err := e.y.eval(s)
+		if err != nil {
+			return nil, err
+		}
+		return isTrue(y), nil
+	} else if e.op == "||" {
+		if isTrue(x) {
+			return true, nil
+		}
+		y, err := e.y.eval(s)
+		if err != nil {
+			return nil, err
+		}
+		return isTrue(y), nil
+	}
+
+	y, err := e.y.eval(s)
+	if err != nil {
+		return nil, err
+	}
+
+	switch e.op {
+	case "==":
+		return compare(x, y) == 0, nil
+	case "!=":
+		return compare(x, y) != 0, nil
+	case "<":
+		return compare(x, y) < 0, nil
+	case "<=":
+		return compare(x, y) <= 0, nil
+	case ">":
+		return compare(x, y) > 0, nil
+	case ">=":
+		return compare(x, y) >= 0, nil
+	}
+
+	a, aok := toNumber(x)
+	b, bok := toNumber(y)
+	if e.op == "+" && (!aok || !bok) {
+		// String concatenation
+		return toString(x) + toString(y), nil
+	}
+	if !aok || !bok {
+		return nil, fmt.Errorf("operator %s expects numbers (%q %s %q)",
+			e.op, toString(x), e.op, toString(y))
+	}
+	switch e.op {
+	case "+":
+		return a + b, nil
+	case "-":
+		return a - b, nil
+	case "*":
+		return a * b, nil
+	case "/":
+		if b == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return a / b, nil
+	case "%":
+		if b == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return math.Mod(a, b), nil
+	}
+	return nil, fmt.Errorf("unknown operator %s", e.op)
+}
+
+func (e *exprRange) eval(s *scope) (any, error) {
+	x, err := e.from.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	y, err := e.to.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	a, aok := toNumber(x)
+	b, bok := toNumber(y)
+	if !aok || !bok {
+		return nil, fmt.Errorf("range expects numbers (%q..%q)", toString(x), toString(y))
+	}
+	if !isInteger(a) || !isInteger(b) {
+		return nil, fmt.Errorf("range expects integers (%v..%v)", a, b)
+	}
+	if b-a+1 > maxRangeLength {
+		return nil, fmt.Errorf("range %v..%v is too large", a, b)
+	}
+	var items []any
+	for n, m := int64(a), int64(b); n <= m; n++ {
+		items = append(items, float64(n))
+	}
+	return items, nil
+}
+
+//////////////////////////////////////////////////////////////////////
+// Values
+
+// isTrue returns true if the given value is considered true in a
+// condition. Empty strings, "0", and "false" are false (so
+// variables defined with <!set> can be used as flags).
+func isTrue(v any) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case string:
+		return v != "" && v != "0" && v != "false"
+	case []any:
+		return len(v) > 0
+	}
+	return true
+}
+
+// toList converts the given value to a list of items to iterate
+// with <!for>. An empty string is an empty list, and any other
+// single value is a list of one item.
+func toList(v any) []any {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case []any:
+		return v
+	case []string:
+		items := make([]any, len(v))
+		for i := range v {
+			items[i] = v[i]
+		}
+		return items
+	case string:
+		if v == "" {
+			return nil
+		}
+	}
+	return []any{v}
+}
+
+func toNumber(v any) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return 0, false
+		}
+		return n, true
+	}
+	return 0, false
+}
+
+// isInteger returns true if the given number is an integer that can
+// be represented exactly as a float64 (so n+1 is a different number).
+func isInteger(n float64) bool {
+	return n == math.Trunc(n) && math.Abs(n) <= 1<<53
+}
+
+func toString(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case []any:
+		items := make([]string, len(v))
+		for i := range v {
+			items[i] = toString(v[i])
+		}
+		return strings.Join(items, " ")
+	}
+	return fmt.Sprint(v)
+}
+
+// compare compares two values numerically if both can be converted
+// to numbers, or as strings in other case.
+func compare(x, y any) int {
+	if _, ok := x.(bool); ok {
+		return strings.Compare(toString(x), toString(isTrue(y)))
+	}
+	if _, ok := y.(bool); ok {
+		return strings.Compare(toString(isTrue(x)), toString(y))
+	}
+	a, aok := toNumber(x)
+	b, bok := toNumber(y)
+	if aok && bok {
+		if a < b {
+			return -1
+		} else if a > b {
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(toString(x), toString(y))
+}
+
+//////////////////////////////////////////////////////////////////////
+// Expression parser
+
+// exprParser is a recursive descent parser for the expressions used
+// in <!if>, <!elseif>, and <!for> elements. The precedence of the
+// operators (from lower to higher) is:
+//
+//	..
+//	||
+//	&&
+//	== !=
+//	< <= > >=
+//	+ -
+//	* / %
+//	! - (unary)
+type exprParser struct {
+	ti *TokensIter
+}
+
+// parseExpr parses an expression from the current token of the given
+// iterator until the end of the element.
+func parseExpr(ti *TokensIter) (expr, error) {
+	p := &exprParser{ti}
+	if ti.token.kind == TokElemEnd {
+		return nil, fmt.Errorf("expected expression")
+	}
+	e, err := p.parseRange()
+	if err != nil {
+		return nil, err
+	}
+	if ti.token.kind != TokElemEnd {
+		return nil, fmt.Errorf("unexpected %q in expression", ti.token.text)
+	}
+	return e, nil
+}
+
+func (p *exprParser) isOp(ops ...string) bool {
+	if p.ti.token.kind != TokOp {
+		return false
+	}
+	for _, op := range ops {
+		if p.ti.token.text == op {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *exprParser) parseBinary(next func() (expr, error), ops ...string) (expr, error) {
+	x, err := next()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp(ops...) {
+		op := p.ti.token.text
+		p.ti.advance()
+		y, err := next()
+		if err != nil {
+			return nil, err
+		}
+		x = &exprBinary{op, x, y}
+	}
+	return x, nil
+}
+
+// parseRange parses a "from..to" range of numbers (both included).
+func (p *exprParser) parseRange() (expr, error) {
+	x, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.isOp("..") {
+		p.ti.advance()
+		y, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return &exprRange{x, y}, nil
+	}
+	return x, nil
+}
+
+func (p *exprParser) parseOr() (expr, error) {
+	return p.parseBinary(p.parseAnd, "||")
+}
+
+func (p *exprParser) parseAnd() (expr, error) {
+	return p.parseBinary(p.parseEquality, "&&")
+}
+
+func (p *exprParser) parseEquality() (expr, error) {
+	return p.parseBinary(p.parseRelational, "==", "!=")
+}
+
+func (p *exprParser) parseRelational() (expr, error) {
+	return p.parseBinary(p.parseAdditive, "<", "<=", ">", ">=")
+}
+
+func (p *exprParser) parseAdditive() (expr, error) {
+	return p.parseBinary(p.parseMultiplicative, "+", "-")
+}
+
+func (p *exprParser) parseMultiplicative() (expr, error) {
+	return p.parseBinary(p.parseUnary, "*", "/", "%")
+}
+
+func (p *exprParser) parseUnary() (expr, error) {
+	if p.isOp("!", "-") {
+		op := p.ti.token.text
+		p.ti.advance()
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &exprUnary{op, x}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (expr, error) {
+	ti := p.ti
+	switch ti.token.kind {
+	case TokPOpen:
+		ti.advance()
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if ti.token.kind != TokPClose {
+			return nil, fmt.Errorf("expected ')' in expression")
+		}
+		ti.advance()
+		return e, nil
+	case TokText:
+		text := ti.token.text
+		separated := ti.token.separated
+		ti.advance()
+
+		if isQuoted(text) {
+			return &exprLiteral{unquote(text)}, nil
+		} else if text == "true" {
+			return &exprLiteral{true}, nil
+		} else if text == "false" {
+			return &exprLiteral{false}, nil
+		} else if n, err := strconv.ParseFloat(text, 64); err == nil {
+			return &exprLiteral{n}, nil
+		}
+
+		// Function call
+		if ti.token.kind == TokPOpen && !separated {
+			ti.advance()
+			arg, err := p.parseArg()
+			if err != nil {
+				return nil, err
+			}
+			if ti.token.kind != TokPClose {
+				return nil, fmt.Errorf("expected ')' after argument of %s()", text)
+			}
+			ti.advance()
+			return &exprCall{text, arg}, nil
+		}
+		return &exprVar{text}, nil
+	case TokElemEnd, TokEof:
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unexpected %q in expression", ti.token.text)
+}
+
+// parseArg parses a function argument, where a bare word is a
+// string literal (e.g. query(id) is the same as query("id")).
+func (p *exprParser) parseArg() (expr, error) {
+	ti := p.ti
+	if ti.token.kind == TokText && !isQuoted(ti.token.text) &&
+		ti.nextTok() == TokPClose {
+		text := ti.token.text
+		ti.advance()
+		return &exprLiteral{text}, nil
+	}
+	return p.parseOr()
+}
+
+// parseArgs parses a list of "name=expression" arguments until the
+// end of the element. If valueRequired is false, arguments can be
+// specified without value (e.g. parameters of <!define>).
+func parseArgs(ti *TokensIter, valueRequired bool) ([]elemArg, error) {
+	p := &exprParser{ti}
+	var args []elemArg
+	for ti.token.kind != TokElemEnd {
+		if ti.token.kind != TokText {
+			return nil, fmt.Errorf("unexpected %q, expected argument name", ti.token.text)
+		}
+		arg := elemArg{name: ti.token.text}
+		ti.advance()
+		if p.isOp("=") {
+			ti.advance()
+			value, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			arg.value = value
+		} else if valueRequired {
+			return nil, fmt.Errorf("expected value for argument '%s'", arg.name)
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+func isQuoted(text string) bool {
+	n := len(text)
+	return n >= 2 && (text[0] == '"' || text[0] == '\'') && text[n-1] == text[0]
+}
+
+func unquote(text string) string {
+	if isQuoted(text) {
+		return text[1 : len(text)-1]
+	}
+	return text
+}
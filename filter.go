@@ -0,0 +1,300 @@
+// Copyright (c) David Capello. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE.txt file.
+
+package htex
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Filter transforms a value printed by <!get>, <!data>, <!query>,
+// or <!url> elements, e.g. <!get title | upper | truncate 60>. The
+// args are the values given after the name of the filter.
+type Filter func(value any, args []any) (any, error)
+
+// elemFilter is a filter used in an element with its arguments
+// (expressions evaluated when the element is printed).
+type elemFilter struct {
+	name string
+	fn   Filter
+	args []expr
+}
+
+// rawValue is a value that is printed as it is, without escaping it
+// (e.g. the result of the "markdown" or "raw" filters).
+type rawValue string
+
+// escapedValue is text escaped by the "escape" filter. It's printed
+// as it is in HTML text (even in raw elements), and the original text
+// is escaped as any other value in other contexts (e.g. a URL or a
+// <script>).
+type escapedValue string
+
+// jsonValue is JSON code generated by the "json" filter, it's
+// printed as it is inside <script> and escaped in other contexts.
+type jsonValue string
+
+var builtinFilters = map[string]Filter{
+	"upper":     filterUpper,
+	"lower":     filterLower,
+	"title":     filterTitle,
+	"trim":      filterTrim,
+	"default":   filterDefault,
+	"truncate":  filterTruncate,
+	"escape":    filterEscape,
+	"urlencode": filterUrlEncode,
+	"json":      filterJson,
+	"date":      filterDate,
+	"number":    filterNumber,
+	"slugify":   filterSlugify,
+	"raw":       filterRaw,
+}
+
+// RegisterFilter adds a custom filter that can be used in .htex
+// files. It replaces a built-in filter with the same name.
+func (h *Htex) RegisterFilter(name string, filter Filter) {
+	h.filters[name] = filter
+}
+
+func (h *Htex) findFilter(name string) (Filter, bool) {
+	if filter, ok := h.filters[name]; ok {
+		return filter, true
+	}
+	if name == "markdown" {
+		return h.filterMarkdown(), true
+	}
+	filter, ok := builtinFilters[name]
+	return filter, ok
+}
+
+// parseFilters parses the list of filters of an element, e.g.
+// "| upper | truncate 60".
+func (h *Htex) parseFilters(ti *TokensIter) ([]elemFilter, error) {
+	p := &exprParser{ti}
+	var filters []elemFilter
+	for p.isOp("|") {
+		ti.advance()
+		if ti.token.kind != TokText {
+			return nil, fmt.Errorf("expected filter name")
+		}
+		name := ti.token.text
+		fn, ok := h.findFilter(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown filter '%s'", name)
+		}
+		filter := elemFilter{name: name, fn: fn}
+		ti.advance()
+		for ti.token.kind != TokElemEnd && !p.isOp("|") {
+			arg, err := p.parseOr()
+			if err != nil {
+				return nil, fmt.Errorf("invalid argument of '%s': %w", name, err)
+			}
+			filter.args = append(filter.args, arg)
+		}
+		filters = append(filters, filter)
+	}
+	if ti.token.kind != TokElemEnd {
+		return nil, fmt.Errorf("unexpected %q, expected '|'", ti.token.text)
+	}
+	return filters, nil
+}
+
+// applyFilters returns the value transformed by the given filters.
+func applyFilters(sc *scope, value any, filters []elemFilter) (any, error) {
+	for _, filter := range filters {
+		args := make([]any, len(filter.args))
+		for i, arg := range filter.args {
+			var err error
+			args[i], err = arg.eval(sc)
+			if err != nil {
+				return nil, err
+			}
+		}
+		var err error
+		value, err = filter.fn(value, args)
+		if err != nil {
+			return nil, fmt.Errorf("filter '%s': %w", filter.name, err)
+		}
+	}
+	return value, nil
+}
+
+func filterArg(args []any, i int, defaultValue any) any {
+	if i < len(args) {
+		return args[i]
+	}
+	return defaultValue
+}
+
+func filterUpper(value any, args []any) (any, error) {
+	return strings.ToUpper(toString(value)), nil
+}
+
+func filterLower(value any, args []any) (any, error) {
+	return strings.ToLower(toString(value)), nil
+}
+
+func filterTitle(value any, args []any) (any, error) {
+	s := []rune(toString(value))
+	for i := range s {
+		if i == 0 || unicode.IsSpace(s[i-1]) {
+			s[i] = unicode.ToUpper(s[i])
+		}
+	}
+	return string(s), nil
+}
+
+func filterTrim(value any, args []any) (any, error) {
+	return strings.TrimSpace(toString(value)), nil
+}
+
+func filterDefault(value any, args []any) (any, error) {
+	if toString(value) == "" {
+		return filterArg(args, 0, ""), nil
+	}
+	return value, nil
+}
+
+func filterTruncate(value any, args []any) (any, error) {
+	n, ok := toNumber(filterArg(args, 0, nil))
+	if !ok || math.IsNaN(n) || math.IsInf(n, 0) {
+		return nil, fmt.Errorf("expected length")
+	}
+	s := toString(value)
+	if n >= float64(utf8.RuneCountInString(s)) {
+		return s, nil
+	}
+	suffix := toString(filterArg(args, 1, "..."))
+	return string([]rune(s)[:int(max(n, 0))]) + suffix, nil
+}
+
+func filterEscape(value any, args []any) (any, error) {
+	return escapedValue(html.EscapeString(toString(value))), nil
+}
+
+func filterUrlEncode(value any, args []any) (any, error) {
+	return url.QueryEscape(toString(value)), nil
+}
+
+func filterJson(value any, args []any) (any, error) {
+	result, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	return jsonValue(result), nil
+}
+
+// Named layouts for the "date" filter
+var dateLayouts = map[string]string{
+	"date":     "2006-01-02",
+	"datetime": "2006-01-02 15:04:05",
+	"rfc3339":  time.RFC3339,
+	"rfc1123":  time.RFC1123Z, // Used by RSS feeds
+}
+
+// filterDate formats a date (a RFC 3339 string, a "2006-01-02"
+// string, or a Unix timestamp) with the given Go layout
+// (e.g. "Jan 2, 2006") or named layout (e.g. "rfc3339").
+func filterDate(value any, args []any) (any, error) {
+	var t time.Time
+	if n, ok := value.(float64); ok {
+		t = time.Unix(int64(n), 0).UTC()
+	} else {
+		s := toString(value)
+		var err error
+		for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"} {
+			t, err = time.Parse(layout, s)
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid date '%s'", s)
+		}
+	}
+	layout := toString(filterArg(args, 0, "date"))
+	if named, ok := dateLayouts[layout]; ok {
+		layout = named
+	}
+	return t.Format(layout), nil
+}
+
+// Maximum number of decimals of the "number" filter
+const maxDecimals = 20
+
+// filterNumber formats a number with thousands separators and the
+// given number of decimals (e.g. <!get price | number 2> prints
+// "1,234.50").
+func filterNumber(value any, args []any) (any, error) {
+	n, ok := toNumber(value)
+	if !ok {
+		return nil, fmt.Errorf("invalid number '%s'", toString(value))
+	}
+	decimals := -1
+	if arg := filterArg(args, 0, nil); arg != nil {
+		d, ok := toNumber(arg)
+		if !ok || math.IsNaN(d) || math.IsInf(d, 0) {
+			return nil, fmt.Errorf("invalid number of decimals")
+		}
+		decimals = int(min(max(d, 0), maxDecimals))
+	}
+	s := strconv.FormatFloat(n, 'f', decimals, 64)
+	sign := ""
+	if s[0] == '-' {
+		sign, s = "-", s[1:]
+	}
+	intPart, fracPart, hasFrac := strings.Cut(s, ".")
+	var b strings.Builder
+	b.WriteString(sign)
+	for i, c := range intPart {
+		if i > 0 && (len(intPart)-i)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(c)
+	}
+	if hasFrac {
+		b.WriteByte('.')
+		b.WriteString(fracPart)
+	}
+	return b.String(), nil
+}
+
+// filterMarkdown returns the "markdown" filter, which uses the
+// markdown options of the server. The value can come from the
+// request, so its raw HTML is escaped.
+func (h *Htex) filterMarkdown() Filter {
+	return func(value any, args []any) (any, error) {
+		return rawValue(markdownToHtml([]byte(toString(value)), h.Markdown, false)), nil
+	}
+}
+
+func filterSlugify(value any, args []any) (any, error) {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(toString(value)) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	return b.String(), nil
+}
+
+func filterRaw(value any, args []any) (any, error) {
+	return rawValue(toString(value)), nil
+}
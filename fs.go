@@ -0,0 +1,165 @@
+// Copyright (c) David Capello. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE.txt file.
+
+package htex
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// fsPath converts a local filename (e.g. localRoot+"/index.htex") to
+// the name of the file in the file system (e.g. "index.htex"). Files
+// outside the root directory cannot be accessed.
+func (h *Htex) fsPath(fn string) (string, error) {
+	rel, err := filepath.Rel(h.localRoot, fn)
+	if err == nil {
+		rel = filepath.ToSlash(rel)
+		if fs.ValidPath(rel) {
+			return rel, nil
+		}
+	}
+	return "", &fs.PathError{Op: "open", Path: fn, Err: fs.ErrNotExist}
+}
+
+func (h *Htex) stat(fn string) (fs.FileInfo, error) {
+	name, err := h.fsPath(fn)
+	if err != nil {
+		return nil, err
+	}
+	return fs.Stat(h.fsys, name)
+}
+
+func (h *Htex) open(fn string) (fs.File, error) {
+	name, err := h.fsPath(fn)
+	if err != nil {
+		return nil, err
+	}
+	return h.fsys.Open(name)
+}
+
+func (h *Htex) readFile(fn string) ([]byte, error) {
+	name, err := h.fsPath(fn)
+	if err != nil {
+		return nil, err
+	}
+	return fs.ReadFile(h.fsys, name)
+}
+
+// copyFile writes the content of the given file without reading the
+// whole file in memory.
+func (h *Htex) copyFile(w io.Writer, fn string) error {
+	f, err := h.open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// isRegularFile returns true if the given file exists and it's not a
+// directory.
+func (h *Htex) isRegularFile(fn string) bool {
+	s, _ := h.stat(fn)
+	return s != nil && s.Mode().IsRegular()
+}
+
+func (h *Htex) isDir(fn string) bool {
+	s, _ := h.stat(fn)
+	return s != nil && s.IsDir()
+}
+
+// serveFile serves the given static file.
+func (h *Htex) serveFile(w http.ResponseWriter, r *http.Request, fn string) {
+	name, err := h.fsPath(fn)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeFileFS(w, r, h.fsys, name)
+}
+
+// overlayFS is a file system where the files of the first layers
+// replace the files of the next ones.
+type overlayFS struct {
+	layers []fs.FS
+}
+
+// NewOverlayFS returns a file system that combines several file
+// systems, e.g. NewOverlayFS(site, theme) to use the files of the
+// site directory and the theme files that are not in the site.
+func NewOverlayFS(layers ...fs.FS) fs.FS {
+	return &overlayFS{layers: layers}
+}
+
+func (o *overlayFS) Open(name string) (fs.File, error) {
+	var firstErr error
+	for _, layer := range o.layers {
+		file, err := layer.Open(name)
+		if err == nil {
+			return file, nil
+		}
+		if firstErr == nil || !errors.Is(err, fs.ErrNotExist) {
+			firstErr = err
+		}
+	}
+	if firstErr == nil {
+		firstErr = &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return nil, firstErr
+}
+
+func (o *overlayFS) Stat(name string) (fs.FileInfo, error) {
+	var firstErr error
+	for _, layer := range o.layers {
+		info, err := fs.Stat(layer, name)
+		if err == nil {
+			return info, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr == nil {
+		firstErr = &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return nil, firstErr
+}
+
+// ReadDir merges the entries of the directory in all layers.
+func (o *overlayFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	var entries []fs.DirEntry
+	found := false
+	var firstErr error
+	for _, layer := range o.layers {
+		layerEntries, err := fs.ReadDir(layer, name)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		found = true
+		for _, entry := range layerEntries {
+			if !slices.ContainsFunc(entries, func(e fs.DirEntry) bool {
+				return e.Name() == entry.Name()
+			}) {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	if !found {
+		return nil, firstErr
+	}
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+	return entries, nil
+}
@@ -49,31 +49,51 @@ func (h *Htex) GenerateStaticContent(outputDir string) {
 	h.ScanFiles(
 		// Dynamic content
 		func(fullFn, query string) {
+			// Error pages are not generated as regular pages
+			if isErrorPage(fullFn) {
+				return
+			}
+
 			outputFn := filepath.Join(outputDir, query, "index.html")
-			mkDirs(fullFn, outputFn)
 
 			// Emulate a GET request to the .htex file to generate its content.
 			w := &pseudoResponseWriter{outputFn, nil, http.Header{}}
 			r := &http.Request{Method: "GET"}
 			r.URL = &url.URL{}
 
-			hf, err := h.parseHtexFile(w, r, fullFn)
+			hf, err := h.parsePageFile(w, r, fullFn)
 			if err != nil {
 				log.Print(err)
-			} else {
-				h.writeHtexFile(w, r, hf, nil)
+				return
+			}
+			// Markdown drafts are not published
+			if hf.draft && !h.Drafts {
+				return
 			}
+			mkDirs(fullFn, outputFn)
+			h.writeHtexFile(w, r, hf, nil)
 		},
 		// Static content
 		func(fullFn, fn string) {
 			outputFn := filepath.Join(outputDir, fn)
 			mkDirs(fullFn, outputFn)
 
-			content, err := os.ReadFile(fullFn)
+			content, err := h.readFile(fullFn)
 			if err != nil {
 				log.Print(err)
 			} else {
 				os.WriteFile(outputFn, content, 0666)
 			}
 		})
+
+	// Custom 404 page for static hosts (e.g. GitHub Pages)
+	if fullFn := h.findErrorPage(h.localRoot, http.StatusNotFound); fullFn != "" {
+		outputFn := filepath.Join(outputDir, "404.html")
+		mkDirs(fullFn, outputFn)
+
+		w := &pseudoResponseWriter{outputFn, nil, http.Header{}}
+		r := &http.Request{Method: "GET"}
+		r.URL = &url.URL{}
+		h.writeError(w, r, nil, h.localRoot, http.StatusNotFound, nil)
+	}
 }
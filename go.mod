@@ -2,4 +2,8 @@ module github.com/dacap/htex
 
 go 1.26
 
-require github.com/gomarkdown/markdown v0.0.0-20250311123330-531bef5e742b // indirect
+require (
+	github.com/BurntSushi/toml v1.6.0
+	github.com/gomarkdown/markdown v0.0.0-20250311123330-531bef5e742b
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -6,20 +6,19 @@ package htex
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
-	"html"
+	"io"
+	"io/fs"
 	"log"
+	"mime"
 	"net/http"
 	"net/url"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
+	"slices"
 	"strings"
-
-	"github.com/gomarkdown/markdown"
-	mhtml "github.com/gomarkdown/markdown/html"
-	"github.com/gomarkdown/markdown/parser"
 )
 
 type ElemKind int
@@ -43,52 +42,122 @@ const (
 	ElemElseIf
 	ElemElse
 	ElemEnd
+	ElemFor         // <!for item in list>
+	ElemDataFile    // <!data-file varname file>
+	ElemDefine      // <!define name params...>
+	ElemCall        // <!call name args...>
+	ElemWrap        // <!wrap name args...>
+	ElemBlock       // <!block name>
+	ElemStatus      // <!status code>
+	ElemHeader      // <!header name value>
+	ElemCookie      // <!cookie name value attrs...>
+	ElemRedirect    // <!redirect url code>
+	ElemContentType // <!content-type type>
+	ElemFlush       // <!flush>
+	ElemUpload      // <!upload field attr>
+	ElemUploadSave  // <!upload-save field>
+	ElemCustom      // Element registered with Htex.RegisterElement()
 )
 
 type Elem struct {
 	kind    ElemKind
 	text    string
 	values  *url.Values
+	path    string // File of <!data-file> elements
 	jump    int
 	jumpEnd int
+	expr    expr         // Condition of <!if>/<!elseif> or list of <!for>
+	args    []elemArg    // Parameters of <!define> or arguments of <!call>/<!wrap>
+	code    int          // HTTP status code of <!status>/<!redirect>
+	value   string       // Value of <!header> or attribute of <!upload>
+	cookie  *http.Cookie // Cookie of <!cookie>
+	ctx     htmlContext  // Context of the printed value to escape it
+	raw     bool         // True if the printed value is not escaped
+	filters []elemFilter // Filters of the printed value
+	custom  *customElement
+	data    any       // Value returned by the parse function of a custom element
+	command []execArg // Arguments of <!exec>
+	pos     Pos
+}
+
+// elemArg is a name=value argument of an element, where value is an
+// expression (or nil if the argument doesn't have a value).
+type elemArg struct {
+	name  string
+	value expr
 }
 
 func newElem(kind ElemKind, text string) Elem {
-	return Elem{kind, text, nil, 0, 0}
+	return Elem{kind: kind, text: text}
 }
 
 type HtexFile struct {
-	fn    string
-	elems []Elem
+	fn      string
+	elems   []Elem
+	defines map[string]int // Index of each <!define> element by name
+	vars    map[string]any // Front matter of markdown pages
+	draft   bool           // Markdown page that is not published
 }
 
 type LayoutResolver func(string) *bufio.Scanner
 
 type Htex struct {
 	localRoot      string
+	fsys           fs.FS  // Files of the localRoot
+	execDir        string // Directory where <!exec> commands are executed
 	verbose        bool
 	KeepComments   bool
 	HttpHandler    http.Handler
 	LayoutResolver LayoutResolver
+	DisableCache   bool              // Parse .htex files in each request (for development)
+	filters        map[string]Filter // Custom filters
+	elements       map[string]*customElement
+	cache          *fileCache     // Parsed .htex files
+	liveReload     *liveReload    // Browsers to reload when files change
+	Server         ServerConfig   // Options of the web server
+	Vars           map[string]any // Variables available in all pages
+	Redirects      []RedirectRule
+	Headers        []HeaderRule // Headers added to the responses
+	Exec           ExecPolicy
+	Upload         UploadPolicy
+	Markdown       MarkdownOptions
+	Drafts         bool // Publish markdown pages with "draft: true"
 }
 
 // relativeTo is a path to the current local filename that is being
 // processed (so relative URLs will be relative to the directory of
 // this file)
 func (h *Htex) solveUrlPathToLocalPath(relativeTo string, urlPath string) string {
-	if urlPath[0] == '/' {
+	if strings.HasPrefix(urlPath, "/") {
 		return filepath.Join(h.localRoot, urlPath)
 	} else {
 		return filepath.Join(filepath.Dir(relativeTo), urlPath)
 	}
 }
 
+// parseHtexFile parses the given file or returns it from the cache if
+// it wasn't modified since the last time it was parsed.
 func (h *Htex) parseHtexFile(w http.ResponseWriter, r *http.Request, fn string) (*HtexFile, error) {
+	info, err := h.stat(fn)
+	if err != nil {
+		h.cache.remove(fn)
+		log.Println(err)
+		return nil, err
+	}
+	if !h.DisableCache {
+		if hf := h.cache.get(fn, info); hf != nil {
+			if h.verbose {
+				log.Println(" -> cached file", fn)
+			}
+			return hf, nil
+		}
+	}
+
 	if h.verbose {
 		log.Println(" -> parse file", fn)
 	}
 
-	file, err := os.Open(fn)
+	file, err := h.open(fn)
 	if err != nil {
 		log.Println(err)
 		return nil, err
@@ -96,27 +165,24 @@ func (h *Htex) parseHtexFile(w http.ResponseWriter, r *http.Request, fn string)
 	defer file.Close()
 
 	scanner := bufio.NewScanner(file)
-	return h.parseHtexScanner(w, r, fn, scanner)
+	hf, err := h.parseHtexScanner(w, r, fn, scanner)
+	if err == nil && !h.DisableCache {
+		h.cache.put(fn, info, hf)
+	}
+	return hf, err
 }
 
 func (h *Htex) parseHtexLayoutFile(w http.ResponseWriter, r *http.Request, fn string) (*HtexFile, error) {
 	if h.verbose {
 		log.Println(" -> parse layout file", fn)
 	}
-	var scanner *bufio.Scanner = nil
 	if h.LayoutResolver != nil {
-		scanner = h.LayoutResolver(fn)
-	}
-	if scanner == nil {
-		file, err := os.Open(fn)
-		if err != nil {
-			log.Println(err)
-			return nil, err
+		scanner := h.LayoutResolver(fn)
+		if scanner != nil {
+			return h.parseHtexScanner(w, r, fn, scanner)
 		}
-		defer file.Close()
-		scanner = bufio.NewScanner(file)
 	}
-	return h.parseHtexScanner(w, r, fn, scanner)
+	return h.parseHtexFile(w, r, fn)
 }
 
 func (h *Htex) parseHtexScanner(w http.ResponseWriter, r *http.Request, fn string, scanner *bufio.Scanner) (*HtexFile, error) {
@@ -128,8 +194,9 @@ func (h *Htex) parseHtexScanner(w http.ResponseWriter, r *http.Request, fn strin
 	}
 
 	// Auxiliary structure to keep track of the current level of
-	// <!if><!elseif><!else><!end> elements to update their
-	// jump/jumpEnd fields.
+	// <!if><!elseif><!else><!end>, <!for><!else><!end>,
+	// <!define><!end>, <!wrap><!end>, and <!block><!end> elements to
+	// update their jump/jumpEnd fields.
 	type Ifs struct {
 		idxs []int
 	}
@@ -149,10 +216,48 @@ func (h *Htex) parseHtexScanner(w http.ResponseWriter, r *http.Request, fn strin
 		return result
 	}
 
-	hf := &HtexFile{fn: fn}
+	// Parses a name that cannot contain whitespace but can be a
+	// path (e.g. "components/card.htex")
+	parseName := func() string {
+		var result string
+		for ti.token.kind != TokElemEnd {
+			result += ti.token.text
+			separated := ti.token.separated
+			ti.advance()
+			if separated {
+				break
+			}
+		}
+		return result
+	}
+
+	hf := &HtexFile{fn: fn, defines: make(map[string]int)}
+
+	// Name and position of the element being parsed to report errors
+	var elemName string
+	var elemPos Pos
+
+	// Returns the given error in the current token position
+	fail := func(err error) (*HtexFile, error) {
+		var perr *ParseError
+		if errors.As(err, &perr) {
+			if perr.Elem == "" {
+				perr.Elem = elemName
+			}
+			return nil, perr
+		}
+		return nil, tokens.errorAt(ti.token.pos, elemName, "%v", err)
+	}
+
+	// Returns an error in the position of the current element
+	failElem := func(format string, args ...any) (*HtexFile, error) {
+		return nil, tokens.errorAt(elemPos, elemName, format, args...)
+	}
+
 	lastMethod := -1
 	for ti.advance() {
 		elem := newElem(ElemNone, "")
+		elemPos = ti.token.pos
 
 		switch ti.token.kind {
 		case TokText:
@@ -160,62 +265,140 @@ func (h *Htex) parseHtexScanner(w http.ResponseWriter, r *http.Request, fn strin
 			break
 		case TokElemBegin:
 			t := strings.ToLower(ti.token.text[2:])
+			elemName = "<!" + t + ">"
 
 			if t == "layout" {
 				ti.advance()
 				layoutFn := parsePath()
+				if layoutFn == "" {
+					return failElem("expected <!layout file>")
+				}
 				layoutFn = h.solveUrlPathToLocalPath(fn, layoutFn)
 				elem = newElem(ElemLayout, layoutFn)
 			} else if t == "content" {
 				elem = newElem(ElemContent, "")
-			} else if t == "get" {
+			} else if t == "get" || t == "get-raw" {
 				err := ti.expectTok(TokText)
 				if err != nil {
-					return hf, err
+					return fail(err)
 				}
 
 				varName := ti.token.text
 				elem = newElem(ElemGet, varName)
+				elem.raw = (t == "get-raw")
+				ti.advance()
+				elem.filters, err = h.parseFilters(ti)
+				if err != nil {
+					return fail(err)
+				}
 			} else if t == "set" {
 				err := ti.expectTok(TokText)
 				if err != nil {
-					return hf, err
+					return fail(err)
 				}
 
 				varName := ti.token.text
 				var values *url.Values = nil
 				ti.advance()
-				for ti.token.kind == TokText {
-					value := ti.token.text
+				for ti.token.kind != TokElemEnd {
+					// Operators are part of the value (e.g. "100%")
+					value := unquote(parseName())
 					if values == nil {
 						values = &url.Values{}
 					}
 					values.Add(varName, value)
-					ti.advance()
 				}
 				elem = newElem(ElemSet, varName)
 				elem.values = values
+			} else if t == "data-file" {
+				err := ti.expectTok(TokText)
+				if err != nil {
+					return fail(err)
+				}
+
+				varName := ti.token.text
+				ti.advance()
+				dataFn := parsePath()
+				if dataFn == "" {
+					return failElem("expected file in <!data-file %s file>", varName)
+				}
+				elem = newElem(ElemDataFile, varName)
+				elem.path = dataFn
 			} else if t == "url" {
 				elem = newElem(ElemUrl, "")
-			} else if t == "data" {
+				ti.advance()
+				filters, err := h.parseFilters(ti)
+				if err != nil {
+					return fail(err)
+				}
+				elem.filters = filters
+			} else if t == "data" || t == "data-raw" {
 				err := ti.expectTok(TokText)
 				if err != nil {
-					return hf, err
+					return fail(err)
 				}
 
 				paramName := ti.token.text
 				elem = newElem(ElemData, paramName)
-			} else if t == "query" {
+				elem.raw = (t == "data-raw")
+				ti.advance()
+				elem.filters, err = h.parseFilters(ti)
+				if err != nil {
+					return fail(err)
+				}
+			} else if t == "upload" {
+				err := ti.expectTok(TokText)
+				if err != nil {
+					return fail(err)
+				}
+				elem = newElem(ElemUpload, ti.token.text)
+				elem.value = "name"
+				ti.advance()
+				if ti.token.kind == TokText {
+					if !isUploadAttr(ti.token.text) {
+						return failElem("invalid attribute '%s' (expected name, size, type, or file)", ti.token.text)
+					}
+					elem.value = ti.token.text
+					ti.advance()
+				}
+				elem.filters, err = h.parseFilters(ti)
+				if err != nil {
+					return fail(err)
+				}
+			} else if t == "upload-save" {
+				err := ti.expectTok(TokText)
+				if err != nil {
+					return fail(err)
+				}
+				elem = newElem(ElemUploadSave, ti.token.text)
+				ti.advance()
+				if ti.token.kind != TokElemEnd {
+					return failElem("unexpected arguments")
+				}
+			} else if t == "query" || t == "query-raw" {
 				var key string
 				if ti.nextTok() == TokText {
 					ti.advance()
 					key = ti.token.text
 				}
 				elem = newElem(ElemQuery, key)
-			} else if t == "exec" {
+				elem.raw = (t == "query-raw")
+				ti.advance()
+				filters, err := h.parseFilters(ti)
+				if err != nil {
+					return fail(err)
+				}
+				elem.filters = filters
+			} else if t == "exec" || t == "exec-raw" {
 				ti.advance()
 				command := parsePath()
+				args, err := parseCommand(command)
+				if err != nil {
+					return failElem("%v", err)
+				}
 				elem = newElem(ElemExec, command)
+				elem.raw = (t == "exec-raw")
+				elem.command = args
 			} else if t == "method" {
 				var methodName string
 				var values *url.Values = nil
@@ -223,14 +406,31 @@ func (h *Htex) parseHtexScanner(w http.ResponseWriter, r *http.Request, fn strin
 					ti.advance()
 					methodName = strings.ToLower(ti.token.text)
 					ti.advance()
-					for ti.token.kind == TokText {
-						nameAndValue := ti.token.text
-						name, value, _ := strings.Cut(nameAndValue, "=")
+					isAssign := func() bool {
+						return ti.token.kind == TokOp && ti.token.text == "="
+					}
+					for ti.token.kind != TokElemEnd {
+						// Names and values can contain operators
+						// (e.g. slug=my-post)
+						var name string
+						separated := false
+						for ti.token.kind != TokElemEnd && !isAssign() && !separated {
+							name += ti.token.text
+							separated = ti.token.separated
+							ti.advance()
+						}
+						value := ""
+						if !separated && isAssign() {
+							separated = ti.token.separated
+							ti.advance()
+							if !separated && ti.token.kind != TokElemEnd {
+								value = unquote(parseName())
+							}
+						}
 						if values == nil {
 							values = &url.Values{}
 						}
 						values.Add(name, value)
-						ti.advance()
 					}
 				}
 				elem = newElem(ElemMethod, methodName)
@@ -242,33 +442,218 @@ func (h *Htex) parseHtexScanner(w http.ResponseWriter, r *http.Request, fn strin
 			} else if t == "include-raw" {
 				ti.advance()
 				includeFn := parsePath()
+				if includeFn == "" {
+					return failElem("expected <!include-raw file>")
+				}
 				elem = newElem(ElemIncludeRaw, includeFn)
 			} else if t == "include-escaped" {
 				ti.advance()
 				includeFn := parsePath()
+				if includeFn == "" {
+					return failElem("expected <!include-escaped file>")
+				}
 				elem = newElem(ElemIncludeEscaped, includeFn)
 			} else if t == "include-markdown" {
+				// Words with "=" (e.g. target-blank=false) or names of
+				// boolean options (e.g. footnotes) are markdown
+				// options, other words are the file name
 				ti.advance()
-				includeFn := parsePath()
-				elem = newElem(ElemIncludeMarkdown, includeFn)
+				var words []string
+				var values url.Values
+				opts := h.Markdown
+				for ti.token.kind != TokElemEnd {
+					word := parseName()
+					name, value, found := strings.Cut(word, "=")
+					if !found && opts.flag(name) == nil {
+						words = append(words, word)
+						continue
+					}
+					if err := opts.setAttr(name, value); err != nil {
+						return failElem("%v", err)
+					}
+					if values == nil {
+						values = url.Values{}
+					}
+					values.Set(name, value)
+				}
+				if len(words) == 0 {
+					return failElem("expected <!include-markdown file>")
+				}
+				elem = newElem(ElemIncludeMarkdown, strings.Join(words, " "))
+				if values != nil {
+					elem.values = &values
+				}
 			} else if t == "if" {
 				ti.advance()
-				elem = newElem(ElemIf, ti.token.text)
+				cond, err := parseExpr(ti)
+				if err != nil {
+					return fail(fmt.Errorf("invalid condition: %w", err))
+				}
+				elem = newElem(ElemIf, "")
+				elem.expr = cond
+				ifs = append(ifs, Ifs{[]int{len(hf.elems)}})
+			} else if t == "for" {
+				err := ti.expectTok(TokText)
+				if err != nil {
+					return fail(err)
+				}
+				varName := ti.token.text
+				ti.advance()
+				if ti.token.kind != TokText || ti.token.text != "in" {
+					return fail(fmt.Errorf("expected <!for %s in list>", varName))
+				}
+				ti.advance()
+				list, err := parseExpr(ti)
+				if err != nil {
+					return fail(fmt.Errorf("invalid list: %w", err))
+				}
+				elem = newElem(ElemFor, varName)
+				elem.expr = list
+				ifs = append(ifs, Ifs{[]int{len(hf.elems)}})
+			} else if t == "define" {
+				err := ti.expectTok(TokText)
+				if err != nil {
+					return fail(err)
+				}
+				name := ti.token.text
+				if _, exist := hf.defines[name]; exist {
+					return failElem("component '%s' already defined", name)
+				}
+				ti.advance()
+				params, err := parseArgs(ti, false)
+				if err != nil {
+					return fail(fmt.Errorf("invalid parameters of '%s': %w", name, err))
+				}
+				elem = newElem(ElemDefine, name)
+				elem.args = params
+				hf.defines[name] = len(hf.elems)
+				ifs = append(ifs, Ifs{[]int{len(hf.elems)}})
+			} else if t == "call" || t == "wrap" {
+				ti.advance()
+				if ti.token.kind == TokElemEnd {
+					return failElem("expected component name")
+				}
+				name := parseName()
+				args, err := parseArgs(ti, true)
+				if err != nil {
+					return fail(fmt.Errorf("invalid arguments for '%s': %w", name, err))
+				}
+				if t == "call" {
+					elem = newElem(ElemCall, name)
+				} else {
+					elem = newElem(ElemWrap, name)
+					ifs = append(ifs, Ifs{[]int{len(hf.elems)}})
+				}
+				elem.args = args
+			} else if t == "block" {
+				err := ti.expectTok(TokText)
+				if err != nil {
+					return fail(err)
+				}
+				elem = newElem(ElemBlock, ti.token.text)
 				ifs = append(ifs, Ifs{[]int{len(hf.elems)}})
+			} else if t == "status" {
+				err := ti.expectTok(TokText)
+				if err != nil {
+					return fail(err)
+				}
+				code, err := parseStatusCode(ti.token.text)
+				if err != nil {
+					return fail(err)
+				}
+				elem = newElem(ElemStatus, "")
+				elem.code = code
+			} else if t == "header" {
+				err := ti.expectTok(TokText)
+				if err != nil {
+					return fail(err)
+				}
+				name := parseName()
+				elem = newElem(ElemHeader, name)
+				elem.value = unquote(parsePath())
+			} else if t == "cookie" {
+				err := ti.expectTok(TokText)
+				if err != nil {
+					return fail(err)
+				}
+				cookie := &http.Cookie{Name: parseName()}
+				if ti.token.kind == TokElemEnd {
+					return failElem("expected <!cookie %s value>", cookie.Name)
+				}
+				cookie.Value = unquote(parseName())
+				for ti.token.kind != TokElemEnd {
+					attrPos := ti.token.pos
+					err := setCookieAttr(cookie, parseName())
+					if err != nil {
+						return nil, tokens.errorAt(attrPos, elemName, "%v", err)
+					}
+				}
+				elem = newElem(ElemCookie, cookie.Name)
+				elem.cookie = cookie
+			} else if t == "redirect" {
+				ti.advance()
+				if ti.token.kind == TokElemEnd {
+					return failElem("expected <!redirect url>")
+				}
+				url := unquote(parseName())
+				code := http.StatusSeeOther
+				if ti.token.kind == TokText {
+					c, err := parseStatusCode(ti.token.text)
+					if err != nil {
+						return fail(err)
+					}
+					if c < 300 || c > 399 {
+						return fail(fmt.Errorf("invalid redirect status code %d", c))
+					}
+					code = c
+				}
+				elem = newElem(ElemRedirect, url)
+				elem.code = code
+			} else if t == "content-type" {
+				ti.advance()
+				contentType := unquote(parsePath())
+				if contentType == "" {
+					return failElem("expected <!content-type type>")
+				}
+				if !strings.Contains(contentType, "/") {
+					ext := contentType
+					contentType = mime.TypeByExtension("." + ext)
+					if contentType == "" {
+						return failElem("unknown content type '%s'", ext)
+					}
+				}
+				elem = newElem(ElemContentType, contentType)
+			} else if t == "flush" {
+				ti.advance()
+				if ti.token.kind != TokElemEnd {
+					return failElem("unexpected arguments")
+				}
+				elem = newElem(ElemFlush, "")
 			} else if t == "elseif" {
 				n := len(ifs)
 				if n == 0 {
-					return nil, fmt.Errorf("unexpected element <!elseif> without <!if>")
+					return failElem("unexpected element without <!if>")
+				}
+				if hf.elems[ifs[n-1].idxs[0]].kind == ElemFor {
+					return failElem("unexpected element inside <!for>")
 				}
 				hf.elems[ifs[n-1].idxs[len(ifs[n-1].idxs)-1]].jump = len(hf.elems)
 				ifs[n-1].idxs = append(ifs[n-1].idxs, len(hf.elems))
 
 				ti.advance()
-				elem = newElem(ElemElseIf, ti.token.text)
+				cond, err := parseExpr(ti)
+				if err != nil {
+					return fail(fmt.Errorf("invalid condition: %w", err))
+				}
+				elem = newElem(ElemElseIf, "")
+				elem.expr = cond
 			} else if t == "else" {
 				n := len(ifs)
 				if n == 0 {
-					return nil, fmt.Errorf("unexpected element <!else> without <!if>")
+					return failElem("unexpected element without <!if>")
+				}
+				if kind := hf.elems[ifs[n-1].idxs[0]].kind; kind != ElemIf && kind != ElemFor {
+					return failElem("unexpected element without <!if>")
 				}
 				hf.elems[ifs[n-1].idxs[len(ifs[n-1].idxs)-1]].jump = len(hf.elems)
 				ifs[n-1].idxs = append(ifs[n-1].idxs, len(hf.elems))
@@ -277,17 +662,32 @@ func (h *Htex) parseHtexScanner(w http.ResponseWriter, r *http.Request, fn strin
 			} else if t == "end" {
 				n := len(ifs)
 				if n == 0 {
-					return nil, fmt.Errorf("unexpected element <!end> without <!if>")
+					return failElem("unexpected element without <!if> or <!for>")
 				}
 				endIdx := len(hf.elems)
 				for j := 0; j < len(ifs[n-1].idxs); j++ {
 					hf.elems[ifs[n-1].idxs[j]].jumpEnd = endIdx
 				}
-				ifs = ifs[:n-1]
 
+				// <!end> jumps back to the element that opened the
+				// block (used to iterate <!for> elements)
 				elem = newElem(ElemEnd, "")
+				elem.jump = ifs[n-1].idxs[0]
+				ifs = ifs[:n-1]
+			} else if custom, ok := h.elements[t]; ok {
+				ti.advance()
+				data, err := custom.parse(parsePath())
+				if err != nil {
+					return failElem("%v", err)
+				}
+				elem = newElem(ElemCustom, t)
+				elem.custom = custom
+				elem.data = data
+				if custom.block {
+					ifs = append(ifs, Ifs{[]int{len(hf.elems)}})
+				}
 			} else {
-				log.Println("invalid htex element", t)
+				log.Println(elemPos, "invalid htex element", t)
 			}
 
 			for ti.token.kind != TokElemEnd {
@@ -296,15 +696,53 @@ func (h *Htex) parseHtexScanner(w http.ResponseWriter, r *http.Request, fn strin
 		}
 
 		if elem.kind != ElemNone {
+			elem.pos = elemPos
 			hf.elems = append(hf.elems, elem)
 		}
 	}
 	if lastMethod >= 0 {
 		hf.elems[lastMethod].jump = len(hf.elems)
 	}
+	if n := len(ifs); n > 0 {
+		opener := &hf.elems[ifs[n-1].idxs[0]]
+		kind := "if"
+		switch opener.kind {
+		case ElemFor:
+			kind = "for"
+		case ElemDefine:
+			kind = "define"
+		case ElemWrap:
+			kind = "wrap"
+		case ElemBlock:
+			kind = "block"
+		case ElemCustom:
+			kind = opener.text
+		}
+		return nil, tokens.errorAt(opener.pos, "<!"+kind+">", "element without <!end>")
+	}
+	setContexts(hf)
 	return hf, nil
 }
 
+// setContexts calculates the context of each value printed in the
+// file to escape it correctly (e.g. a value inside an HTML attribute
+// or a <script>).
+func setContexts(hf *HtexFile) {
+	var ctx htmlContext
+	for i := range hf.elems {
+		elem := &hf.elems[i]
+		switch elem.kind {
+		case ElemText:
+			ctx.feed(elem.text)
+		case ElemContentType:
+			ctx.setContentType(elem.text)
+		case ElemGet, ElemData, ElemQuery, ElemUrl, ElemCustom:
+			elem.ctx = ctx
+			ctx.feedValue()
+		}
+	}
+}
+
 func matchQuery(a *url.Values, b *url.Values) bool {
 	for k, v := range *a {
 		if !b.Has(k) {
@@ -320,25 +758,132 @@ func matchQuery(a *url.Values, b *url.Values) bool {
 	return true
 }
 
-func markdownToHtml(md []byte) []byte {
-	extensions := parser.CommonExtensions | parser.AutoHeadingIDs | parser.NoEmptyLineBeforeBlock
-	p := parser.NewWithExtensions(extensions)
-	doc := p.Parse(md)
-	htmlFlags := mhtml.CommonFlags | mhtml.HrefTargetBlank
-	opts := mhtml.RendererOptions{Flags: htmlFlags}
-	renderer := mhtml.NewRenderer(opts)
-	return markdown.Render(doc, renderer)
+// forLoop is the state of a <!for> element being iterated.
+type forLoop struct {
+	start    int // Index of the <!for> element
+	varName  string
+	items    []any
+	i        int
+	prevVar  any // Previous values of the variables that the loop hides
+	prevLoop any
+}
+
+func newForLoop(sc *scope, start int, varName string, items []any) *forLoop {
+	return &forLoop{
+		start:    start,
+		varName:  varName,
+		items:    items,
+		i:        0,
+		prevVar:  sc.vars[varName],
+		prevLoop: sc.vars["loop"],
+	}
+}
+
+// setVars sets the loop variable to the current item, and the
+// "loop" variable with the loop.index, loop.number, loop.first,
+// loop.last, and loop.length helpers.
+func (loop *forLoop) setVars(sc *scope) {
+	n := len(loop.items)
+	sc.vars[loop.varName] = loop.items[loop.i]
+	sc.vars["loop"] = map[string]any{
+		"index":  float64(loop.i),
+		"number": float64(loop.i + 1),
+		"first":  loop.i == 0,
+		"last":   loop.i == n-1,
+		"length": float64(n),
+	}
 }
 
-func (h *Htex) writeHtexFile0(w http.ResponseWriter, r *http.Request, hf *HtexFile, content func(http.ResponseWriter, *http.Request), searchLayout bool) {
+func (loop *forLoop) restoreVars(sc *scope) {
+	restore := func(name string, value any) {
+		if value != nil {
+			sc.vars[name] = value
+		} else {
+			delete(sc.vars, name)
+		}
+	}
+	restore(loop.varName, loop.prevVar)
+	restore("loop", loop.prevLoop)
+}
+
+// evalCondition evaluates the condition of an <!if>/<!elseif>
+// element, an expression that cannot be evaluated is logged and
+// considered false.
+func (h *Htex) evalCondition(sc *scope, elem *Elem) bool {
+	value, err := elem.expr.eval(sc)
+	if err != nil {
+		log.Println(elem.pos, "error evaluating condition:", err)
+		return false
+	}
+	return isTrue(value)
+}
+
+// blockRef references a <!block> element of a file that replaces
+// the block with the same name in its layout.
+type blockRef struct {
+	hf  *HtexFile
+	idx int
+}
+
+// blocks contains, for each block name, the list of <!block>
+// elements that replace the block in the layout (from the page to
+// the most external layout).
+type blocks map[string][]blockRef
+
+func (b blocks) isReplacement(hf *HtexFile, idx int, name string) bool {
+	for _, ref := range b[name] {
+		if ref.hf == hf && ref.idx == idx {
+			return true
+		}
+	}
+	return false
+}
+
+// writeValue prints the value of a <!get>, <!data>, <!query>, or
+// <!url> element transformed by its filters and escaped for its
+// context (unless it's a raw element).
+func writeValue(w http.ResponseWriter, sc *scope, elem *Elem, value any) {
+	if len(elem.filters) > 0 {
+		var err error
+		value, err = applyFilters(sc, value, elem.filters)
+		if err != nil {
+			log.Println(elem.pos, err)
+			return
+		}
+	}
+	if elem.raw {
+		w.Write([]byte(toString(value)))
+	} else {
+		w.Write([]byte(elem.ctx.escape(value)))
+	}
+}
+
+// setVar executes a <!set> element in the given scope.
+func setVar(sc *scope, elem *Elem) {
+	if elem.values != nil {
+		sc.vars[elem.text] = values((*elem.values)[elem.text])
+	} else {
+		delete(sc.vars, elem.text)
+	}
+}
+
+// writeHtexFile0 renders the given file. The scope is shared between
+// a page and its layouts, so variables defined in the page are
+// visible from its layouts (and its layouts cannot replace them).
+func (h *Htex) writeHtexFile0(w http.ResponseWriter, r *http.Request, hf *HtexFile, content func(http.ResponseWriter, *http.Request), searchLayout bool, sc *scope) {
 	methodName := strings.ToLower(r.Method)
 	query := r.URL.Query()
 
-	// Find the layout that matches the HTTP method/query the most
+	// Find the layout that matches the HTTP method/query the most,
+	// and set the top-level variables of the file before rendering
+	// the layout
 	var layout *HtexFile = nil
+	var fileBlocks []blockRef
 	skipUntilNewMethod := false
 	if searchLayout {
-		for _, elem := range hf.elems {
+		for i := 0; i < len(hf.elems); i++ {
+			elem := hf.elems[i]
+
 			if elem.kind == ElemMethod {
 				if ((elem.text == methodName) && (elem.values == nil || matchQuery(elem.values, &query))) ||
 					elem.text == "any" {
@@ -354,28 +899,176 @@ func (h *Htex) writeHtexFile0(w http.ResponseWriter, r *http.Request, hf *HtexFi
 				var err error
 				layout, err = h.parseHtexLayoutFile(w, r, layoutFn)
 				if err != nil {
-					log.Println("layout not found:", hf.fn)
-					http.Error(w, "500 internal error", http.StatusInternalServerError)
+					var perr *ParseError
+					if !errors.As(err, &perr) {
+						err = fmt.Errorf("%v: layout not found: %s", elem.pos, layoutFn)
+					}
+					log.Println(err)
+					h.writeError(w, r, sc, filepath.Dir(sc.layouts[0]), http.StatusInternalServerError, err)
 					return
 				}
-			} else {
-				// TODO what to do with ElemGet/ElemSet?
+			} else if elem.kind == ElemBlock {
+				fileBlocks = append(fileBlocks, blockRef{hf, i})
+				i = elem.jumpEnd
+			} else if elem.kind == ElemSet {
+				if sc.canSetVar(hf, elem.text) {
+					setVar(sc, &elem)
+					sc.varFiles[elem.text] = hf
+				}
+			} else if elem.kind == ElemIf ||
+				elem.kind == ElemFor ||
+				elem.kind == ElemDefine ||
+				elem.kind == ElemWrap ||
+				(elem.kind == ElemCustom && elem.custom.block) {
+				// Variables inside these elements are set only
+				// when the file is rendered
+				i = elem.jumpEnd
 			}
 		}
 	}
 
 	if layout != nil {
-		h.writeHtexFile(w, r, layout,
+		// Detect cycles in the chain of layouts (e.g. a page with
+		// layout A, where A uses layout B, and B uses layout A)
+		if slices.Contains(sc.layouts, layout.fn) {
+			err := fmt.Errorf("layout cycle: %s", strings.Join(append(sc.layouts, layout.fn), " -> "))
+			log.Println(err)
+			h.writeError(w, r, sc, filepath.Dir(sc.layouts[0]), http.StatusInternalServerError, err)
+			return
+		}
+		sc.layouts = append(sc.layouts, layout.fn)
+
+		// The blocks of this file will replace the blocks of the
+		// layout
+		for _, ref := range fileBlocks {
+			name := hf.elems[ref.idx].text
+			sc.blocks[name] = append(sc.blocks[name], ref)
+		}
+
+		h.writeHtexFile0(w, r, layout,
 			func(w http.ResponseWriter, r *http.Request) {
-				h.writeHtexFile0(w, r, hf, content, false)
-			})
+				h.writeHtexFile0(w, r, hf, content, false, sc)
+			}, true, sc)
+		return
+	}
+
+	h.writeElems(w, r, hf, 0, len(hf.elems), sc, content)
+}
+
+// writeBlock renders the first <!block> element of the given list,
+// where <!content> is replaced with the next block of the list (or
+// the default content of the layout block at the end).
+func (h *Htex) writeBlock(w http.ResponseWriter, r *http.Request, sc *scope, refs []blockRef, defaultContent func(http.ResponseWriter, *http.Request)) {
+	if len(refs) == 0 {
+		defaultContent(w, r)
+		return
+	}
+	ref := refs[0]
+	h.writeElems(w, r, ref.hf, ref.idx+1, ref.hf.elems[ref.idx].jumpEnd, sc,
+		func(w http.ResponseWriter, r *http.Request) {
+			h.writeBlock(w, r, sc, refs[1:], defaultContent)
+		})
+}
+
+// Maximum number of nested <!call>/<!wrap> elements, and maximum
+// number of components rendered in a request. Both limits are needed
+// to stop recursive components, e.g. a component that calls itself
+// twice would render 2^maxCallDepth components.
+const (
+	maxCallDepth = 64
+	maxCalls     = 10000
+)
+
+// calls counts the components rendered in a request.
+type calls struct {
+	count  int
+	logged bool // True if a limit was already reached (to log it once)
+}
+
+// exceeded logs the given error the first time that a limit is
+// reached in the request.
+func (c *calls) exceeded(pos Pos, format string, args ...any) {
+	if !c.logged {
+		c.logged = true
+		log.Println(pos, fmt.Sprintf(format, args...))
+	}
+}
+
+// writeComponent renders the <!define> element or the .htex file
+// with the given name with the arguments of the given <!call> or
+// <!wrap> element.
+func (h *Htex) writeComponent(w http.ResponseWriter, r *http.Request, hf *HtexFile, elem *Elem, sc *scope, content func(http.ResponseWriter, *http.Request)) {
+	if sc.depth >= maxCallDepth {
+		sc.calls.exceeded(elem.pos, "too many nested components calling %s", elem.text)
 		return
 	}
+	if sc.calls.count >= maxCalls {
+		sc.calls.exceeded(elem.pos, "too many components rendered calling %s", elem.text)
+		return
+	}
+	sc.calls.count++
+
+	csc := h.newPageScope(r)
+	csc.depth = sc.depth + 1
+	csc.blocks = sc.blocks
+	csc.calls = sc.calls
+
+	// Component defined in the same file with <!define>, or a .htex
+	// file (all its elements are the component body)
+	compHf := hf
+	from, to := 0, 0
+	if idx, exist := hf.defines[elem.text]; exist {
+		def := &hf.elems[idx]
+		for _, param := range def.args {
+			var value any = ""
+			if param.value != nil {
+				var err error
+				value, err = param.value.eval(csc)
+				if err != nil {
+					log.Println(def.pos, "error evaluating default value of", param.name+":", err)
+				}
+			}
+			csc.vars[param.name] = value
+		}
+		from, to = idx+1, def.jumpEnd
+	} else {
+		fn := h.solveUrlPathToLocalPath(hf.fn, elem.text)
+		if path.Ext(fn) == "" {
+			fn += ".htex"
+		}
+		var err error
+		compHf, err = h.parseHtexFile(w, r, fn)
+		if err != nil {
+			var perr *ParseError
+			if errors.As(err, &perr) {
+				log.Println(err)
+			} else {
+				log.Println(elem.pos, "component not found:", elem.text)
+			}
+			return
+		}
+		from, to = 0, len(compHf.elems)
+	}
+
+	for _, arg := range elem.args {
+		value, err := arg.value.eval(sc)
+		if err != nil {
+			log.Println(elem.pos, "error evaluating argument", arg.name+":", err)
+		}
+		csc.vars[arg.name] = value
+	}
+	h.writeElems(w, r, compHf, from, to, csc, content)
+}
+
+// writeElems renders the elements of the given file in the range
+// [from, to) using the given scope for variables.
+func (h *Htex) writeElems(w http.ResponseWriter, r *http.Request, hf *HtexFile, from, to int, sc *scope, content func(http.ResponseWriter, *http.Request)) {
+	methodName := strings.ToLower(r.Method)
+	query := sc.query
 
 	var insideIf []bool
-	vars := make(map[string]string)
-	n := len(hf.elems)
-	for i := 0; i < n; i++ {
+	var loops []*forLoop
+	for i := from; i < to && !isDone(w); i++ {
 		elem := hf.elems[i]
 
 		if elem.kind == ElemMethod {
@@ -395,62 +1088,149 @@ func (h *Htex) writeHtexFile0(w http.ResponseWriter, r *http.Request, hf *HtexFi
 				// <!content> element with nothing.
 			}
 		} else if elem.kind == ElemGet {
-			value, exist := vars[elem.text]
-			if exist {
-				w.Write([]byte(value))
+			value, exist := sc.lookup(elem.text)
+			if exist || len(elem.filters) > 0 {
+				writeValue(w, sc, &elem, value)
 			}
 		} else if elem.kind == ElemSet {
-			if elem.values != nil {
-				vars[elem.text] = (*elem.values)[elem.text][0]
+			if sc.canSetVar(hf, elem.text) {
+				setVar(sc, &elem)
+			}
+		} else if elem.kind == ElemBlock {
+			if sc.blocks.isReplacement(hf, i, elem.text) {
+				// Blocks that replace layout blocks are rendered
+				// from the layout
+			} else {
+				begin, end := i+1, elem.jumpEnd
+				h.writeBlock(w, r, sc, sc.blocks[elem.text],
+					func(w http.ResponseWriter, r *http.Request) {
+						h.writeElems(w, r, hf, begin, end, sc, content)
+					})
+			}
+			i = elem.jumpEnd
+		} else if elem.kind == ElemDefine {
+			// Skip the component body (it's rendered with <!call>)
+			i = elem.jumpEnd
+		} else if elem.kind == ElemCall {
+			h.writeComponent(w, r, hf, &elem, sc, nil)
+		} else if elem.kind == ElemWrap {
+			// The content inside <!wrap>...<!end> is rendered in the
+			// current scope where the component uses <!content>
+			begin, end := i+1, elem.jumpEnd
+			h.writeComponent(w, r, hf, &elem, sc,
+				func(w http.ResponseWriter, r *http.Request) {
+					h.writeElems(w, r, hf, begin, end, sc, content)
+				})
+			i = elem.jumpEnd
+		} else if elem.kind == ElemCustom {
+			ctx := &ElementContext{Writer: w, Request: r, sc: sc, elem: &elem}
+			if elem.custom.block {
+				begin, end := i+1, elem.jumpEnd
+				ctx.content = func() {
+					h.writeElems(w, r, hf, begin, end, sc, content)
+				}
+			}
+			err := elem.custom.render(ctx, elem.data)
+			if err != nil {
+				log.Println(elem.pos, "<!"+elem.text+">", err)
+			}
+			if elem.custom.block {
+				i = elem.jumpEnd
+			}
+		} else if elem.kind == ElemDataFile {
+			fn := h.solveUrlPathToLocalPath(hf.fn, elem.path)
+			data, err := h.loadDataFile(fn)
+			if err != nil {
+				log.Println(elem.pos, "cannot load data file:", err)
 			} else {
-				delete(vars, elem.text)
+				sc.vars[elem.text] = data
 			}
 		} else if elem.kind == ElemUrl {
-			w.Write([]byte(path.Clean(r.URL.Path)))
+			writeValue(w, sc, &elem, path.Clean(r.URL.Path))
 		} else if elem.kind == ElemData {
 			if r.Form.Has(elem.text) {
-				w.Write([]byte(r.Form[elem.text][0]))
+				writeValue(w, sc, &elem, r.Form[elem.text][0])
+			} else if len(elem.filters) > 0 {
+				writeValue(w, sc, &elem, nil)
+			}
+		} else if elem.kind == ElemUpload {
+			value := uploadAttr(r, elem.text, elem.value)
+			if value != nil || len(elem.filters) > 0 {
+				writeValue(w, sc, &elem, value)
+			}
+		} else if elem.kind == ElemUploadSave {
+			if err := h.saveUpload(r, elem.text); err != nil {
+				log.Println(elem.pos, "cannot save uploaded file:", err)
 			}
 		} else if elem.kind == ElemQuery {
 			if len(elem.text) > 0 {
 				if query.Has(elem.text) {
-					w.Write([]byte(query.Get(elem.text)))
+					writeValue(w, sc, &elem, query.Get(elem.text))
+				} else if len(elem.filters) > 0 {
+					writeValue(w, sc, &elem, nil)
 				}
 			} else {
-				w.Write([]byte(r.URL.RawQuery))
+				writeValue(w, sc, &elem, r.URL.RawQuery)
+			}
+		} else if elem.kind == ElemStatus {
+			w.WriteHeader(elem.code)
+		} else if elem.kind == ElemHeader {
+			w.Header().Set(elem.text, elem.value)
+		} else if elem.kind == ElemContentType {
+			w.Header().Set("Content-Type", elem.text)
+		} else if elem.kind == ElemCookie {
+			http.SetCookie(w, elem.cookie)
+		} else if elem.kind == ElemRedirect {
+			if rb, ok := w.(*responseBuffer); ok {
+				rb.redirect(r, elem.text, elem.code)
+				return
+			}
+			http.Redirect(w, r, elem.text, elem.code)
+		} else if elem.kind == ElemFlush {
+			if rb, ok := w.(*responseBuffer); ok {
+				rb.Flush()
 			}
 		} else if elem.kind == ElemExec {
-			args := strings.Fields(elem.text)
-			cmd := exec.Command(args[0], args[1:]...)
-			cmd.Dir = h.localRoot
-			out, err := cmd.Output()
-			if err != nil {
-				log.Print(err)
-			} else {
-				w.Write([]byte(html.EscapeString(string(out))))
+			args := make([]string, len(elem.command))
+			for i, arg := range elem.command {
+				args[i] = arg.eval(sc)
 			}
+			h.writeCommand(w, r, &elem, args)
 		} else if elem.kind == ElemIncludeRaw ||
-			elem.kind == ElemIncludeEscaped ||
-			elem.kind == ElemIncludeMarkdown {
+			elem.kind == ElemIncludeEscaped {
 
+			// The file is copied in chunks, so big files are
+			// streamed after <!flush>
 			fn := h.solveUrlPathToLocalPath(hf.fn, elem.text)
-			content, err := os.ReadFile(fn)
+			var out io.Writer = w
 			if elem.kind == ElemIncludeEscaped {
-				content = []byte(html.EscapeString(string(content)))
-			} else if elem.kind == ElemIncludeMarkdown {
-				content = markdownToHtml(content)
+				out = &escapeWriter{w: w}
 			}
-
+			if err := h.copyFile(out, fn); err != nil {
+				log.Print(err)
+			}
+		} else if elem.kind == ElemIncludeMarkdown {
+			fn := h.solveUrlPathToLocalPath(hf.fn, elem.text)
+			content, err := h.readFile(fn)
 			if err != nil {
 				log.Print(err)
 			} else {
-				w.Write(content)
+				// Skip the front matter of markdown pages
+				if _, md, ferr := parseFrontMatter(content); ferr == nil {
+					content = md
+				}
+				opts := h.Markdown
+				if elem.values != nil {
+					for name := range *elem.values {
+						opts.setAttr(name, elem.values.Get(name))
+					}
+				}
+				w.Write(markdownToHtml(content, opts, true))
 			}
 		} else if elem.kind == ElemText {
 			w.Write([]byte(elem.text))
 		} else if elem.kind == ElemIf {
-			// TODO evaluate any kind of expression from "elem"
-			cond := (elem.text == "true")
+			cond := h.evalCondition(sc, &elem)
 			insideIf = append(insideIf, cond)
 
 			if cond {
@@ -469,8 +1249,7 @@ func (h *Htex) writeHtexFile0(w http.ResponseWriter, r *http.Request, hf *HtexFi
 				// Go to <!end> as we already entered in the first <!if>
 				i = elem.jumpEnd - 1
 			} else {
-				// TODO evaluate any kind of expression from "elem"
-				if elem.text == "true" {
+				if h.evalCondition(sc, &elem) {
 					insideIf[len(insideIf)-1] = true
 				} else if elem.jump > 0 {
 					i = elem.jump - 1
@@ -478,6 +1257,26 @@ func (h *Htex) writeHtexFile0(w http.ResponseWriter, r *http.Request, hf *HtexFi
 					i = elem.jumpEnd - 1
 				}
 			}
+		} else if elem.kind == ElemFor {
+			value, err := elem.expr.eval(sc)
+			if err != nil {
+				log.Println(elem.pos, "error evaluating <!for> list:", err)
+			}
+			loop := newForLoop(sc, i, elem.text, toList(value))
+			loops = append(loops, loop)
+
+			if len(loop.items) > 0 {
+				loop.setVars(sc)
+			} else if elem.jump > 0 {
+				// Enter in the <!else>...<!end>
+				i = elem.jump
+			} else {
+				i = elem.jumpEnd - 1
+			}
+		} else if elem.kind == ElemElse && hf.elems[hf.elems[elem.jumpEnd].jump].kind == ElemFor {
+			// End of the iteration of a <!for> element with
+			// <!else>, go to <!end> to start the next iteration
+			i = elem.jumpEnd - 1
 		} else if elem.kind == ElemElse {
 			if len(insideIf) == 0 {
 				log.Print("unexpected <!else> without <!if>")
@@ -490,13 +1289,84 @@ func (h *Htex) writeHtexFile0(w http.ResponseWriter, r *http.Request, hf *HtexFi
 				// Enter in the <!else>...<!end>
 			}
 		} else if elem.kind == ElemEnd {
-			insideIf = insideIf[:len(insideIf)-1]
+			if hf.elems[elem.jump].kind == ElemFor {
+				loop := loops[len(loops)-1]
+				loop.i++
+				if loop.i < len(loop.items) {
+					loop.setVars(sc)
+					i = loop.start
+				} else {
+					loop.restoreVars(sc)
+					loops = loops[:len(loops)-1]
+				}
+			} else {
+				insideIf = insideIf[:len(insideIf)-1]
+			}
 		}
 	}
 }
 
 func (h *Htex) writeHtexFile(w http.ResponseWriter, r *http.Request, hf *HtexFile, content func(http.ResponseWriter, *http.Request)) {
-	h.writeHtexFile0(w, r, hf, content, true)
+	sc := h.newPageScope(r)
+	for name, value := range hf.vars {
+		sc.vars[name] = value
+		sc.varFiles[name] = hf
+	}
+	sc.layouts = []string{hf.fn}
+	rb := newResponseBuffer(w)
+	r, stop := rb.streamFor(r, h.Server.MaxStreamDuration)
+	defer stop()
+	h.writeHtexFile0(rb, r, hf, content, true, sc)
+	h.injectLiveReload(rb)
+	rb.commit()
+}
+
+// newPageScope returns the scope to render a page or a component
+// with the variables of the configuration file.
+func (h *Htex) newPageScope(r *http.Request) *scope {
+	sc := newScope(r)
+	for name, value := range h.Vars {
+		sc.vars[name] = value
+	}
+	return sc
+}
+
+// parsePageFile parses a .htex or .md page.
+func (h *Htex) parsePageFile(w http.ResponseWriter, r *http.Request, fn string) (*HtexFile, error) {
+	if path.Ext(fn) == ".md" {
+		return h.parseMarkdownFile(fn)
+	}
+	return h.parseHtexFile(w, r, fn)
+}
+
+// serveHtexFile serves the dynamic content of the given .htex or .md
+// file.
+func (h *Htex) serveHtexFile(w http.ResponseWriter, r *http.Request, fn string) {
+	hdr := w.Header()
+	hdr.Set("Content-Type", "text/html; charset=utf-8")
+	if h.verbose {
+		log.Println(" -> dynamic file", fn)
+	}
+	hf, err := h.parsePageFile(w, r, fn)
+	if err != nil {
+		log.Println(err)
+		h.writeError(w, r, nil, filepath.Dir(fn), http.StatusInternalServerError, err)
+		return
+	}
+	if hf.draft && !h.Drafts {
+		h.writeError(w, r, nil, filepath.Dir(fn), http.StatusNotFound, nil)
+		return
+	}
+	r, err = h.parseRequestForm(w, r)
+	if err != nil {
+		if h.verbose {
+			log.Println(" -> invalid form:", err)
+		}
+		h.writeError(w, r, nil, filepath.Dir(fn), formErrorCode(err), err)
+		return
+	}
+	defer removeUploads(r)
+	h.writeHtexFile(w, r, hf, nil)
 }
 
 func (h *Htex) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -506,6 +1376,10 @@ func (h *Htex) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		log.Println(r.RemoteAddr, r.Method, r.URL)
 	}
 
+	if h.applyRules(w, r, url) {
+		return
+	}
+
 	fn := path.Join(h.localRoot, url)
 	base := path.Base(fn)
 
@@ -513,10 +1387,17 @@ func (h *Htex) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		fn = filepath.Join(filepath.Dir(fn), "index")
 	}
 
-	// Ignore requests to access ".htex" files as static content
+	// Ignore requests to access ".htex" and ".md" files as static
+	// content (markdown pages are served without the extension, and
+	// their source can contain drafts)
 	ext := path.Ext(fn)
-	if ext == ".htex" {
-		http.NotFound(w, r)
+	if ext == ".htex" || ext == ".md" {
+		h.writeError(w, r, nil, filepath.Dir(fn), http.StatusNotFound, nil)
+		return
+	}
+
+	if h.liveReload != nil && url == liveReloadUrl {
+		h.liveReload.serveEvents(w, r)
 		return
 	}
 
@@ -528,113 +1409,94 @@ func (h *Htex) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		if verbose {
 			log.Println(" -> ignore hidden dir", fn)
 		}
-		http.NotFound(w, r)
+		h.writeError(w, r, nil, h.localRoot, http.StatusNotFound, nil)
 		return
 	}
 
-	s, _ := os.Stat(fn)
-
 	// Static files
-	if s != nil && s.Mode().IsRegular() {
+	if h.isRegularFile(fn) {
 		if verbose {
 			log.Println(" -> static file", fn)
 		}
-		http.ServeFile(w, r, fn)
+		h.serveFile(w, r, fn)
 		return
 	}
 
 	// Directory files
-	if s != nil && s.Mode().IsDir() {
+	if h.isDir(fn) {
 		fn = fn + "/index"
 	}
 
-	// Dynamic content from .htex file
-	s, _ = os.Stat(fn + ".htex")
-	if s != nil && s.Mode().IsRegular() {
-		fn = fn + ".htex"
-		hdr := w.Header()
-		hdr.Set("Content-Type", "text/html; charset=utf-8")
-		if h.verbose {
-			log.Println(" -> dynamic file", fn)
-		}
-		hf, _ := h.parseHtexFile(w, r, fn)
-		if hf != nil {
-			r.ParseForm()
-			h.writeHtexFile(w, r, hf, nil)
-		}
+	// Dynamic content from .htex file (error pages are used only
+	// to respond with errors)
+	if h.isRegularFile(fn+".htex") && !isErrorPage(fn+".htex") {
+		h.serveHtexFile(w, r, fn+".htex")
+		return
+	}
+
+	// Markdown pages
+	if h.isRegularFile(fn + ".md") {
+		h.serveHtexFile(w, r, fn+".md")
 		return
 	}
 
 	// Wildcard handler from "_.htex" file
 	fnDir, _ := filepath.Split(fn)
 	wildcardFn := filepath.Join(fnDir, "_.htex")
-	s, _ = os.Stat(wildcardFn)
-	if s != nil && s.Mode().IsRegular() {
-		fn = wildcardFn
-		hdr := w.Header()
-		hdr.Set("Content-Type", "text/html; charset=utf-8")
-		if h.verbose {
-			log.Println(" -> dynamic file", fn)
-		}
-		hf, _ := h.parseHtexFile(w, r, fn)
-		if hf != nil {
-			r.ParseForm()
-			h.writeHtexFile(w, r, hf, nil)
-		}
+	if h.isRegularFile(wildcardFn) {
+		h.serveHtexFile(w, r, wildcardFn)
 		return
 	}
 
 	// Static content from .html file. Generally this is only for
 	// the index.html when we access / or other URL path without
 	// index.html and there is no index.htex first. Any other
-	// static .html file is served with the first http.ServeFile()
-	s, _ = os.Stat(fn + ".html")
-	if s != nil && s.Mode().IsRegular() {
+	// static .html file is served with the first h.serveFile()
+	if h.isRegularFile(fn + ".html") {
 		fn = fn + ".html"
 		hdr := w.Header()
 		hdr.Set("Content-Type", "text/html; charset=utf-8")
 		if h.verbose {
 			log.Println(" -> static file", fn)
 		}
-		http.ServeFile(w, r, fn)
+		h.serveFile(w, r, fn)
 		return
 	}
 
 	// 404
-	http.NotFound(w, r)
+	h.writeError(w, r, nil, filepath.Dir(fn), http.StatusNotFound, nil)
 }
 
-func (h *Htex) RunWebServer(port int, fullchain string, privkey string) {
-	s, err := os.Stat(h.localRoot)
-	if err != nil || s == nil || !s.Mode().IsDir() {
-		log.Fatalln("cannot open directory:", h.localRoot)
-	}
+// NewHtex creates a server for the files of the given local
+// directory.
+func NewHtex(localRoot string, verbose bool) *Htex {
+	h := newHtex(localRoot, os.DirFS(localRoot), verbose)
+	h.execDir = localRoot
+	return h
+}
 
-	if fullchain != "" && privkey != "" {
-		// Start HTTPS server
-		if port == 0 {
-			port = 443
-		}
-		fmt.Printf("htex server at https://localhost:%d for %s\n", port, h.localRoot)
-		log.Fatal(http.ListenAndServeTLS(
-			fmt.Sprint(":", port), fullchain, privkey, h.HttpHandler))
-	} else {
-		// Start HTTP server
-		if port == 0 {
-			port = 80
-		}
-		fmt.Printf("htex server at http://localhost:%d for %s\n", port, h.localRoot)
-		log.Fatal(http.ListenAndServe(fmt.Sprint(":", port), h.HttpHandler))
-	}
+// NewHtexFS creates a server for the files of the given file system
+// (e.g. an embed.FS, a zip.Reader, or a NewOverlayFS()). Commands
+// of <!exec> elements are executed in the current directory.
+func NewHtexFS(fsys fs.FS, verbose bool) *Htex {
+	return newHtex(string(filepath.Separator), fsys, verbose)
 }
 
-func NewHtex(localRoot string, verbose bool) *Htex {
+func newHtex(localRoot string, fsys fs.FS, verbose bool) *Htex {
 	h := &Htex{
 		localRoot:      localRoot,
+		fsys:           fsys,
 		verbose:        verbose,
 		KeepComments:   false,
 		HttpHandler:    nil,
 		LayoutResolver: nil,
+		filters:        make(map[string]Filter),
+		elements:       make(map[string]*customElement),
+		cache:          newFileCache(),
+		Server:         DefaultServerConfig,
+		Exec:           DefaultExecPolicy,
+		Upload:         DefaultUploadPolicy,
+		Markdown:       DefaultMarkdownOptions,
 	}
 	if verbose {
 		h.HttpHandler = &LogHtexHandler{handler: h}
@@ -7,11 +7,22 @@ package htex
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"testing"
+	"testing/fstest"
+	"time"
 )
 
 type memoryResponseWriter struct {
@@ -41,7 +52,7 @@ type ParseTest struct {
 
 func testParsing(h *Htex, t *testing.T, tests []ParseTest) {
 	for _, test := range tests {
-		w := &memoryResponseWriter{}
+		w := &memoryResponseWriter{hdr: http.Header{}}
 
 		method, urlPath, _ := strings.Cut(test.reqStr, " ")
 		r := &http.Request{Method: method}
@@ -287,6 +298,19 @@ func TestVars(t *testing.T) {
 			"abcbc",
 			[]ElemKind{ElemText, ElemSet, ElemGet, ElemSet, ElemGet, ElemGet, ElemSet, ElemGet},
 		},
+		// Values with operators
+		{
+			"GET /",
+			"<!set w 100%><!get w>,<!set msg Hello!><!get msg>,<!set v x|y><!get v>,<!set d a-b+c=d&&e><!get d>",
+			"100%,Hello!,x|y,a-b+c=d&amp;&amp;e",
+			[]ElemKind{ElemSet, ElemGet, ElemText, ElemSet, ElemGet, ElemText, ElemSet, ElemGet, ElemText, ElemSet, ElemGet},
+		},
+		{
+			"GET /",
+			`<!set list a! "b c" 50%><!for x in list>[<!get x>]<!end>`,
+			"[a!][b c][50%]",
+			[]ElemKind{ElemSet, ElemFor, ElemText, ElemGet, ElemText, ElemEnd},
+		},
 	}
 	h := NewHtex(".", false)
 	testParsing(h, t, tests)
@@ -421,3 +445,1850 @@ func TestIfs(t *testing.T) {
 	h := NewHtex(".", false)
 	testParsing(h, t, tests)
 }
+
+func TestIfExpressions(t *testing.T) {
+	tests := []ParseTest{
+		{
+			"GET /",
+			"<!if !false>a<!end>",
+			"a",
+			[]ElemKind{ElemIf, ElemText, ElemEnd},
+		},
+		{
+			"GET /",
+			"<!if true && false>a<!elseif true || false>b<!end>",
+			"b",
+			[]ElemKind{ElemIf, ElemText, ElemElseIf, ElemText, ElemEnd},
+		},
+		{
+			"GET /",
+			"<!if (1 + 2) * 3 == 9>a<!end><!if 10 / 4 != 2.5>b<!end>",
+			"a",
+			[]ElemKind{ElemIf, ElemText, ElemEnd, ElemIf, ElemText, ElemEnd},
+		},
+		{
+			"GET /",
+			"<!if (2 < 10) && (3 >= 3)>a<!end><!if (\"b\" > \"a\")>b<!end>",
+			"ab",
+			[]ElemKind{ElemIf, ElemText, ElemEnd, ElemIf, ElemText, ElemEnd},
+		},
+		{
+			"GET /",
+			"<!set a 5><!if a == 5>a<!end><!if a - 1 == 4>b<!end><!if b>c<!end>",
+			"ab",
+			[]ElemKind{ElemSet, ElemIf, ElemText, ElemEnd, ElemIf, ElemText, ElemEnd, ElemIf, ElemText, ElemEnd},
+		},
+		{
+			"GET /",
+			"<!set name \"htex server\"><!if name == \"htex server\">a<!end>",
+			"a",
+			[]ElemKind{ElemSet, ElemIf, ElemText, ElemEnd},
+		},
+		{
+			"GET /?id=42&mode=edit",
+			"<!if query(id) == 42 && query(mode) == \"edit\">a<!else>b<!end>",
+			"a",
+			[]ElemKind{ElemIf, ElemText, ElemElse, ElemText, ElemEnd},
+		},
+		{
+			"GET /?id=7",
+			"<!if (query(id) > 10)>a<!elseif (query(id) > 5)>b<!else>c<!end>",
+			"b",
+			[]ElemKind{ElemIf, ElemText, ElemElseIf, ElemText, ElemElse, ElemText, ElemEnd},
+		},
+		{
+			"GET /",
+			"<!if data(email)>a<!else>b<!end>",
+			"b",
+			[]ElemKind{ElemIf, ElemText, ElemElse, ElemText, ElemEnd},
+		},
+	}
+	h := NewHtex(".", false)
+	testParsing(h, t, tests)
+}
+
+func TestIfInvalidExpressions(t *testing.T) {
+	h := NewHtex(".", false)
+	for _, text := range []string{
+		"<!if>a<!end>",
+		"<!if (a>a<!end>",
+		"<!if a &&>a<!end>",
+		"<!if a b>a<!end>",
+	} {
+		w := &memoryResponseWriter{}
+		r := &http.Request{Method: "GET"}
+		r.URL, _ = url.ParseRequestURI("/")
+		s := bufio.NewScanner(strings.NewReader(text))
+		_, err := h.parseHtexScanner(w, r, "test.htex", s)
+		if err == nil {
+			t.Errorf("parsing '%s' should fail", text)
+		}
+	}
+}
+
+func TestFor(t *testing.T) {
+	tests := []ParseTest{
+		{
+			"GET /",
+			"<!set colors red green blue><!for c in colors>[<!get c>]<!end>",
+			"[red][green][blue]",
+			[]ElemKind{ElemSet, ElemFor, ElemText, ElemGet, ElemText, ElemEnd},
+		},
+		{
+			"GET /",
+			"<!for i in 1..3><!get i><!if !loop.last>,<!end><!end>",
+			"1,2,3",
+			[]ElemKind{ElemFor, ElemGet, ElemIf, ElemText, ElemEnd, ElemEnd},
+		},
+		{
+			"GET /",
+			"<!for i in 1..2><!for j in 1..2><!get loop.number><!end>-<!get loop.index>;<!end>",
+			"12-0;12-1;",
+			[]ElemKind{ElemFor, ElemFor, ElemGet, ElemEnd, ElemText, ElemGet, ElemText, ElemEnd},
+		},
+		{
+			"GET /",
+			"<!set x a><!for x in 1..2><!get x><!end><!get x>",
+			"12a",
+			[]ElemKind{ElemSet, ElemFor, ElemGet, ElemEnd, ElemGet},
+		},
+		{
+			"GET /",
+			"<!for x in empty>a<!else>b<!end>c",
+			"bc",
+			[]ElemKind{ElemFor, ElemText, ElemElse, ElemText, ElemEnd, ElemText},
+		},
+		{
+			"GET /",
+			"<!set one 1><!for x in one>a<!get x><!else>b<!end>c",
+			"a1c",
+			[]ElemKind{ElemSet, ElemFor, ElemText, ElemGet, ElemElse, ElemText, ElemEnd, ElemText},
+		},
+		{
+			"GET /?tag=a&tag=b&tag=c",
+			"<!for tag in query(tag)><!if loop.first>(<!end><!get tag><!if loop.last>)<!end><!end>",
+			"(abc)",
+			[]ElemKind{ElemFor, ElemIf, ElemText, ElemEnd, ElemGet, ElemIf, ElemText, ElemEnd, ElemEnd},
+		},
+		{
+			"GET /?n=3",
+			"<!for i in 2..query(n)*2><!get i>/<!get loop.length> <!end>",
+			"2/5 3/5 4/5 5/5 6/5 ",
+			[]ElemKind{ElemFor, ElemGet, ElemText, ElemGet, ElemText, ElemEnd},
+		},
+		{
+			"GET /?n=-2",
+			"<!for i in query(n)..query(n)+2><!get i> <!end>",
+			"-2 -1 0 ",
+			[]ElemKind{ElemFor, ElemGet, ElemText, ElemEnd},
+		},
+	}
+	for _, n := range []string{"1e18", "1e20", "-1e20", "Inf", "-Inf", "NaN", "1.5"} {
+		tests = append(tests, ParseTest{
+			"GET /?n=" + n,
+			"<!for i in query(n)..query(n)>a<!else>none<!end>",
+			"none",
+			[]ElemKind{ElemFor, ElemText, ElemElse, ElemText, ElemEnd},
+		})
+	}
+	for _, r := range []string{"1..100001", "-Inf..Inf", "0..1e300", "1..2.5"} {
+		tests = append(tests, ParseTest{
+			"GET /",
+			"<!for i in " + r + ">a<!else>none<!end>",
+			"none",
+			[]ElemKind{ElemFor, ElemText, ElemElse, ElemText, ElemEnd},
+		})
+	}
+	h := NewHtex(".", false)
+	testParsing(h, t, tests)
+}
+
+func TestDataFiles(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"site.json": `{"title": "htex", "menu": [{"title": "home", "url": "/"}, {"title": "docs", "url": "/docs/"}]}`,
+		"team.csv":  "name,role\ndavid,dev\nana,design\n",
+		"site.yaml": "title: htex\ntags:\n  - a\n  - b\ncount: 2\n",
+		"site.toml": "title = \"htex\"\n[[products]]\nname = \"x\"\nprice = 10\n",
+	}
+	for fn, content := range files {
+		err := os.WriteFile(dir+"/"+fn, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []ParseTest{
+		{
+			"GET /",
+			"<!data-file site /site.json><!get site.title>:<!get site.menu.1.title>",
+			"htex:docs",
+			[]ElemKind{ElemDataFile, ElemGet, ElemText, ElemGet},
+		},
+		{
+			"GET /",
+			"<!data-file site /site.json><!for item in site.menu><a href=\"<!get item.url>\"><!get item.title></a><!end>",
+			"<a href=\"/\">home</a><a href=\"/docs/\">docs</a>",
+			[]ElemKind{ElemDataFile, ElemFor, ElemText, ElemGet, ElemText, ElemGet, ElemText, ElemEnd},
+		},
+		{
+			"GET /",
+			"<!data-file team /team.csv><!for m in team><!if m.role == \"dev\"><!get m.name><!end><!end>",
+			"david",
+			[]ElemKind{ElemDataFile, ElemFor, ElemIf, ElemGet, ElemEnd, ElemEnd},
+		},
+		{
+			"GET /",
+			"<!data-file site /site.yaml><!if site.count == 2><!get site.tags></a><!end>",
+			"a b</a>",
+			[]ElemKind{ElemDataFile, ElemIf, ElemGet, ElemText, ElemEnd},
+		},
+		{
+			"GET /",
+			"<!data-file site /site.toml><!for p in site.products><!get p.name>=<!get p.price><!end>",
+			"x=10",
+			[]ElemKind{ElemDataFile, ElemFor, ElemGet, ElemText, ElemGet, ElemEnd},
+		},
+		{
+			"GET /",
+			"<!data-file site /missing.json>a<!get site>",
+			"a",
+			[]ElemKind{ElemDataFile, ElemText, ElemGet},
+		},
+	}
+	h := NewHtex(dir, false)
+	testParsing(h, t, tests)
+}
+
+func TestMethodQueryValues(t *testing.T) {
+	tests := []ParseTest{
+		{
+			"GET /?id=2",
+			"<!method get id=1>one<!method get id=2>two<!method any>",
+			"two",
+			[]ElemKind{ElemMethod, ElemText, ElemMethod, ElemText, ElemMethod},
+		},
+		{
+			"GET /?id=1&name=x",
+			"<!method get name id=1>a<!method any>",
+			"a",
+			[]ElemKind{ElemMethod, ElemText, ElemMethod},
+		},
+		// Values with operators
+		{
+			"GET /?slug=my",
+			"<!method get slug=my-post>a<!method any>b",
+			"b",
+			[]ElemKind{ElemMethod, ElemText, ElemMethod, ElemText},
+		},
+		{
+			"GET /?slug=my-post&x-y=1",
+			"<!method get slug=my-post x-y>a<!method any>b",
+			"ab",
+			[]ElemKind{ElemMethod, ElemText, ElemMethod, ElemText},
+		},
+	}
+	h := NewHtex(".", false)
+	testParsing(h, t, tests)
+}
+
+func TestComponents(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(dir+"/button.htex", []byte("<button><!get label><!content></button>"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []ParseTest{
+		{
+			"GET /",
+			"<!define card title>[<!get title>]<!end>a<!call card title=\"x\"><!call card title=\"y\">",
+			"a[x][y]",
+			[]ElemKind{ElemDefine, ElemText, ElemGet, ElemText, ElemEnd, ElemText, ElemCall, ElemCall},
+		},
+		{
+			"GET /",
+			"<!define link url=\"#\" text>(<!get url>,<!get text>)<!end><!call link text=\"a\"><!call link url=\"/b\" text=\"b\">",
+			"(#,a)(/b,b)",
+			[]ElemKind{ElemDefine, ElemText, ElemGet, ElemText, ElemGet, ElemText, ElemEnd, ElemCall, ElemCall},
+		},
+		{
+			"GET /",
+			"<!set x 1><!define item n>(<!get n>,<!get x>)<!end><!for i in 1..2><!call item n=i*10><!end>",
+			"(10,)(20,)",
+			[]ElemKind{ElemSet, ElemDefine, ElemText, ElemGet, ElemText, ElemGet, ElemText, ElemEnd, ElemFor, ElemCall, ElemEnd},
+		},
+		{
+			"GET /",
+			"<!define box><div><!content></div><!end><!set x 2><!wrap box>x=<!get x><!end>",
+			"<div>x=2</div>",
+			[]ElemKind{ElemDefine, ElemText, ElemContent, ElemText, ElemEnd, ElemSet, ElemWrap, ElemText, ElemGet, ElemEnd},
+		},
+		{
+			"GET /",
+			"<!call /button label=\"ok\"><!wrap /button.htex label=\"a\">b<!end>",
+			"<button>ok</button><button>ab</button>",
+			[]ElemKind{ElemCall, ElemWrap, ElemText, ElemEnd},
+		},
+		{
+			"GET /",
+			"<!define loop>a<!call loop><!end><!call loop>",
+			strings.Repeat("a", maxCallDepth),
+			[]ElemKind{ElemDefine, ElemText, ElemCall, ElemEnd, ElemCall},
+		},
+		// Each call renders two components
+		{
+			"GET /",
+			"<!define c>a<!call c><!call c><!end><!call c>",
+			strings.Repeat("a", maxCalls),
+			[]ElemKind{ElemDefine, ElemText, ElemCall, ElemCall, ElemEnd, ElemCall},
+		},
+	}
+	h := NewHtex(dir, false)
+	testParsing(h, t, tests)
+}
+
+func TestBlocks(t *testing.T) {
+	tests := []ParseTest{
+		// Layout defaults
+		{
+			"GET /",
+			"<!layout site>hi",
+			"<title>site</title>hi",
+			[]ElemKind{ElemLayout, ElemText},
+		},
+		// Replace layout blocks
+		{
+			"GET /",
+			"<!layout site><!block title>page<!end>hi<!block scripts>[js]<!end>",
+			"<title>page</title>[js]hi",
+			[]ElemKind{ElemLayout, ElemBlock, ElemText, ElemEnd, ElemText, ElemBlock, ElemText, ElemEnd},
+		},
+		// Append to the layout block with <!content>
+		{
+			"GET /",
+			"<!layout site><!block title><!content> - page<!end>hi",
+			"<title>site - page</title>hi",
+			[]ElemKind{ElemLayout, ElemBlock, ElemContent, ElemText, ElemEnd, ElemText},
+		},
+		// Nested layouts
+		{
+			"GET /",
+			"<!layout section>hi",
+			"<title>section</title><nav>hi</nav>",
+			[]ElemKind{ElemLayout, ElemText},
+		},
+		{
+			"GET /",
+			"<!layout section><!block title>page / <!content><!end>hi",
+			"<title>page / section</title><nav>hi</nav>",
+			[]ElemKind{ElemLayout, ElemBlock, ElemText, ElemContent, ElemEnd, ElemText},
+		},
+		// Blocks are rendered in place without a layout
+		{
+			"GET /",
+			"a<!block title>b<!end>c",
+			"abc",
+			[]ElemKind{ElemText, ElemBlock, ElemText, ElemEnd, ElemText},
+		},
+	}
+	h := NewHtex(".", false)
+	h.LayoutResolver = func(layoutFn string) *bufio.Scanner {
+		if layoutFn == "site" {
+			return bufio.NewScanner(strings.NewReader(
+				"<title><!block title>site<!end></title><!block scripts><!end><!content>"))
+		} else if layoutFn == "section" {
+			return bufio.NewScanner(strings.NewReader(
+				"<!layout site><!block title>section<!end><nav><!content></nav>"))
+		} else {
+			return nil
+		}
+	}
+	testParsing(h, t, tests)
+}
+
+func TestLayoutVars(t *testing.T) {
+	tests := []ParseTest{
+		{
+			"GET /",
+			"<!layout site><!set title \"my page\">hi",
+			"<title>my page</title>hi",
+			[]ElemKind{ElemLayout, ElemSet, ElemText},
+		},
+		{
+			"GET /",
+			"<!layout site>hi",
+			"<title>site</title>hi",
+			[]ElemKind{ElemLayout, ElemText},
+		},
+		// Variables inside <!if> are set only when the page is rendered
+		{
+			"GET /",
+			"<!layout site><!if true><!set title page><!end>hi",
+			"<title>site</title>hi",
+			[]ElemKind{ElemLayout, ElemIf, ElemSet, ElemEnd, ElemText},
+		},
+		// Variables set in a <!method> that doesn't match
+		{
+			"POST /",
+			"<!layout site><!method get><!set title get><!method post>hi",
+			"<title>site</title>hi",
+			[]ElemKind{ElemLayout, ElemMethod, ElemSet, ElemMethod, ElemText},
+		},
+		// Nested layouts see variables from the page and inner layouts
+		{
+			"GET /",
+			"<!layout section><!set title page>hi",
+			"<title>page</title><nav>docs</nav>hi",
+			[]ElemKind{ElemLayout, ElemSet, ElemText},
+		},
+		// Variables of the page have precedence over the variables
+		// of its layouts
+		{
+			"GET /",
+			"<!layout docs><!set title Page>hi|<!get title>",
+			"<title>Page</title><nav>Page</nav>hi|Page",
+			[]ElemKind{ElemLayout, ElemSet, ElemText, ElemGet},
+		},
+		{
+			"GET /",
+			"<!layout docs>hi|<!get title>",
+			"<title>Docs</title><nav>Docs</nav>hi|Docs",
+			[]ElemKind{ElemLayout, ElemText, ElemGet},
+		},
+	}
+	h := NewHtex(".", false)
+	h.LayoutResolver = func(layoutFn string) *bufio.Scanner {
+		if layoutFn == "site" {
+			return bufio.NewScanner(strings.NewReader(
+				"<title><!if title><!get title><!else>site<!end></title><!content>"))
+		} else if layoutFn == "section" {
+			return bufio.NewScanner(strings.NewReader(
+				"<!layout site><!set section docs><nav><!get section></nav><!content>"))
+		} else if layoutFn == "docs" {
+			return bufio.NewScanner(strings.NewReader(
+				"<!layout site><!set title Docs><nav><!get title></nav><!content>"))
+		} else {
+			return nil
+		}
+	}
+	testParsing(h, t, tests)
+}
+
+func TestNestedLayouts(t *testing.T) {
+	tests := []ParseTest{
+		// page -> docs -> site
+		{
+			"GET /",
+			"<!layout docs>hi",
+			"<body><nav>docs</nav><main>hi</main></body>",
+			[]ElemKind{ElemLayout, ElemText},
+		},
+		// Layout cycles
+		{
+			"GET /",
+			"<!layout a>hi",
+			"500 internal error\n",
+			[]ElemKind{ElemLayout, ElemText},
+		},
+		{
+			"GET /",
+			"<!layout self>hi",
+			"500 internal error\n",
+			[]ElemKind{ElemLayout, ElemText},
+		},
+	}
+	h := NewHtex(".", false)
+	h.LayoutResolver = func(layoutFn string) *bufio.Scanner {
+		layouts := map[string]string{
+			"site": "<body><!content></body>",
+			"docs": "<!layout site><nav>docs</nav><main><!content></main>",
+			"a":    "<!layout b>a<!content>",
+			"b":    "<!layout a>b<!content>",
+			"self": "<!layout self><!content>",
+		}
+		if text, ok := layouts[layoutFn]; ok {
+			return bufio.NewScanner(strings.NewReader(text))
+		}
+		return nil
+	}
+	testParsing(h, t, tests)
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		text string
+		err  string
+	}{
+		{
+			"a\n  <!if a b>c<!end>",
+			"test.htex:2:10: <!if> invalid condition: unexpected \"b\" in expression\n\t  <!if a b>c<!end>\n\t         ^",
+		},
+		{
+			"<!if a>\n<!for x in y>\n<!end>",
+			"test.htex:1:1: <!if> element without <!end>\n\t<!if a>\n\t^",
+		},
+		{
+			"a\n\t<!else>",
+			"test.htex:2:2: <!else> unexpected element without <!if>\n\t\t<!else>\n\t\t^",
+		},
+		{
+			"<!get>",
+			"test.htex:1:6: <!get> expected text, '>' found\n\t<!get>\n\t     ^",
+		},
+		{
+			"<!for x of y><!end>",
+			"test.htex:1:9: <!for> expected <!for x in list>\n\t<!for x of y><!end>\n\t        ^",
+		},
+		{
+			"<!status abc>",
+			"test.htex:1:10: <!status> invalid status code 'abc'\n\t<!status abc>\n\t         ^",
+		},
+		{
+			"<!redirect /a 200>",
+			"test.htex:1:15: <!redirect> invalid redirect status code 200\n\t<!redirect /a 200>\n\t              ^",
+		},
+		{
+			"<!cookie a b secure lax>",
+			"test.htex:1:21: <!cookie> invalid cookie attribute 'lax'\n\t<!cookie a b secure lax>\n\t                    ^",
+		},
+		{
+			"<!layout>",
+			"test.htex:1:1: <!layout> expected <!layout file>\n\t<!layout>\n\t^",
+		},
+		{
+			"<!include-raw >",
+			"test.htex:1:1: <!include-raw> expected <!include-raw file>\n\t<!include-raw >\n\t^",
+		},
+		{
+			"<!include-escaped>",
+			"test.htex:1:1: <!include-escaped> expected <!include-escaped file>\n\t<!include-escaped>\n\t^",
+		},
+		{
+			"<!include-markdown footnotes>",
+			"test.htex:1:1: <!include-markdown> expected <!include-markdown file>\n\t<!include-markdown footnotes>\n\t^",
+		},
+	}
+	h := NewHtex(".", false)
+	for _, test := range tests {
+		w := &memoryResponseWriter{hdr: http.Header{}}
+		r := &http.Request{Method: "GET"}
+		r.URL, _ = url.ParseRequestURI("/")
+		s := bufio.NewScanner(strings.NewReader(test.text))
+		_, err := h.parseHtexScanner(w, r, "test.htex", s)
+		if err == nil {
+			t.Errorf("parsing '%s' should fail", test.text)
+		} else if err.Error() != test.err {
+			t.Errorf("parsing '%s' error:\n%v\n(expected)\n%s", test.text, err, test.err)
+		}
+	}
+}
+
+func TestErrorPages(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"index.htex":      "<!layout missing>hi",
+		"404.htex":        "<h1><!get status> <!get statusText></h1>",
+		"error.htex":      "<!get status>: <!get error>",
+		"docs/index.htex": "docs",
+		"docs/404.htex":   "docs <!get status>",
+	}
+	for fn, content := range files {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, fn)), os.ModePerm)
+		err := os.WriteFile(filepath.Join(dir, fn), []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		urlPath  string
+		code     int
+		expected string
+	}{
+		{"/docs/", http.StatusOK, "docs"},
+		{"/nope", http.StatusNotFound, "<h1>404 Not Found</h1>"},
+		{"/404", http.StatusNotFound, "<h1>404 Not Found</h1>"},
+		{"/index.htex", http.StatusNotFound, "<h1>404 Not Found</h1>"},
+		{"/docs/nope", http.StatusNotFound, "docs 404"},
+		{"/docs/a/b", http.StatusNotFound, "docs 404"},
+		{"/", http.StatusInternalServerError, "500: "},
+	}
+	h := NewHtex(dir, false)
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", test.urlPath, nil)
+		h.ServeHTTP(w, r)
+		result := w.Body.String()
+		if w.Code != test.code {
+			t.Errorf("GET %s returned status %d (expected %d)", test.urlPath, w.Code, test.code)
+		}
+		if !strings.HasPrefix(result, test.expected) {
+			t.Errorf("GET %s => '%s' (expected '%s')", test.urlPath, result, test.expected)
+		}
+	}
+
+	// Without error pages
+	os.Remove(filepath.Join(dir, "404.htex"))
+	os.Remove(filepath.Join(dir, "error.htex"))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/nope", nil))
+	if w.Code != http.StatusNotFound || w.Body.String() != "404 page not found\n" {
+		t.Errorf("GET /nope => %d '%s'", w.Code, w.Body.String())
+	}
+}
+
+func TestResponseElements(t *testing.T) {
+	tests := []struct {
+		reqStr   string
+		text     string
+		code     int
+		headers  map[string]string
+		expected string
+	}{
+		{
+			"GET /",
+			"<p>created</p><!status 201>",
+			http.StatusCreated,
+			nil,
+			"<p>created</p>",
+		},
+		{
+			"GET /",
+			"<!content-type json>{\"a\": 1}",
+			http.StatusOK,
+			map[string]string{"Content-Type": "application/json"},
+			"{\"a\": 1}",
+		},
+		{
+			"GET /",
+			"<!content-type application/rss+xml><rss/>",
+			http.StatusOK,
+			map[string]string{"Content-Type": "application/rss+xml"},
+			"<rss/>",
+		},
+		{
+			"GET /",
+			"<!header Cache-Control max-age=60, public><!header X-Title \"a  b\">ok",
+			http.StatusOK,
+			map[string]string{"Cache-Control": "max-age=60, public", "X-Title": "a  b"},
+			"ok",
+		},
+		{
+			"GET /",
+			"<!cookie my-session abc= path=/ max-age=3600 httponly samesite=lax>ok",
+			http.StatusOK,
+			map[string]string{"Set-Cookie": "my-session=abc=; Path=/; Max-Age=3600; HttpOnly; SameSite=Lax"},
+			"ok",
+		},
+		{
+			"GET /",
+			"<!cookie session \"\" max-age=0>ok",
+			http.StatusOK,
+			map[string]string{"Set-Cookie": "session=; Max-Age=0"},
+			"ok",
+		},
+		{
+			"POST /",
+			"<!method get>form<!method post>saved<!redirect /done?id=1>after",
+			http.StatusSeeOther,
+			map[string]string{"Location": "/done?id=1"},
+			"",
+		},
+		{
+			"GET /",
+			"<!if 1>a<!redirect /b 301><!end>c",
+			http.StatusMovedPermanently,
+			map[string]string{"Location": "/b"},
+			"<a href=\"/b\">Moved Permanently</a>.\n\n",
+		},
+	}
+	h := NewHtex(".", false)
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		method, urlPath, _ := strings.Cut(test.reqStr, " ")
+		r := httptest.NewRequest(method, urlPath, nil)
+
+		s := bufio.NewScanner(strings.NewReader(test.text))
+		hf, err := h.parseHtexScanner(w, r, "test.htex", s)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		h.writeHtexFile(w, r, hf, nil)
+
+		if w.Code != test.code {
+			t.Errorf("parsing '%s' returned status %d (expected %d)", test.text, w.Code, test.code)
+		}
+		for name, value := range test.headers {
+			if w.Header().Get(name) != value {
+				t.Errorf("parsing '%s' header %s: '%s' (expected '%s')", test.text, name, w.Header().Get(name), value)
+			}
+		}
+		if result := w.Body.String(); result != test.expected {
+			t.Errorf("parsing '%s' => '%s' (expected '%s')", test.text, result, test.expected)
+		}
+	}
+}
+
+func TestEscaping(t *testing.T) {
+	q := func(s string) string {
+		return "GET /?q=" + url.QueryEscape(s)
+	}
+	tests := []ParseTest{
+		{
+			q("<script>alert(1)</script>"),
+			"<p><!query q></p>",
+			"<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>",
+			[]ElemKind{ElemText, ElemQuery, ElemText},
+		},
+		{
+			q("\"><script>"),
+			"<input value=\"<!query q>\">",
+			"<input value=\"&#34;&gt;&lt;script&gt;\">",
+			[]ElemKind{ElemText, ElemQuery, ElemText},
+		},
+		{
+			q("a onmouseover=alert(1)"),
+			"<input value=<!query q>>",
+			"<input value=a&#32;onmouseover&#61;alert(1)>",
+			[]ElemKind{ElemText, ElemQuery, ElemText},
+		},
+		{
+			q("javascript:alert(1)"),
+			"<a href=\"<!query q>\">x</a>",
+			"<a href=\"#ZhtexZ\">x</a>",
+			[]ElemKind{ElemText, ElemQuery, ElemText},
+		},
+		{
+			q("https://htex.dev/a b"),
+			"<a href=\"<!query q>\">x</a>",
+			"<a href=\"https://htex.dev/a%20b\">x</a>",
+			[]ElemKind{ElemText, ElemQuery, ElemText},
+		},
+		{
+			q("a b&c"),
+			"<a href='/search?q=<!query q>'>x</a>",
+			"<a href='/search?q=a+b%26c'>x</a>",
+			[]ElemKind{ElemText, ElemQuery, ElemText},
+		},
+		{
+			q("\";alert(1)//"),
+			"<script>var s = \"<!query q>\";</script>",
+			"<script>var s = \"\\u0022;alert(1)//\";</script>",
+			[]ElemKind{ElemText, ElemQuery, ElemText},
+		},
+		{
+			q("</script><script>alert(1)"),
+			"<script>var s = <!query q>;</script><p><!query q></p>",
+			"<script>var s = \"\\u003c/script\\u003e\\u003cscript\\u003ealert(1)\";</script><p>&lt;/script&gt;&lt;script&gt;alert(1)</p>",
+			[]ElemKind{ElemText, ElemQuery, ElemText, ElemQuery, ElemText},
+		},
+		{
+			q("');alert(1)//"),
+			"<button onclick=\"f('<!query q>')\">x</button>",
+			"<button onclick=\"f('\\u0027);alert(1)//')\">x</button>",
+			[]ElemKind{ElemText, ElemQuery, ElemText},
+		},
+		{
+			q("red;background:url(x)"),
+			"<p style=\"color: <!query q>\">x</p>",
+			"<p style=\"color: red\\3b background\\3a url\\28 x\\29 \">x</p>",
+			[]ElemKind{ElemText, ElemQuery, ElemText},
+		},
+		{
+			q("<b>"),
+			"<!set x \"<i>\"><!get-raw x><!query-raw q>|<!get x><!query q>",
+			"<i><b>|&lt;i&gt;&lt;b&gt;",
+			[]ElemKind{ElemSet, ElemGet, ElemQuery, ElemText, ElemGet, ElemQuery},
+		},
+		{
+			q("a\"b"),
+			"<!content-type json>{\"q\": <!query q>, \"s\": \"<!query q>\"}",
+			"{\"q\": \"a\\\"b\", \"s\": \"a\\u0022b\"}",
+			[]ElemKind{ElemContentType, ElemText, ElemQuery, ElemText, ElemQuery, ElemText},
+		},
+		{
+			q("<b>"),
+			"<!content-type text/plain><!query q>",
+			"<b>",
+			[]ElemKind{ElemContentType, ElemQuery},
+		},
+		{
+			"GET /%3Cb%3E",
+			"<p><!url></p>",
+			"<p>/&lt;b&gt;</p>",
+			[]ElemKind{ElemText, ElemUrl, ElemText},
+		},
+		{
+			q("javascript:alert(1)"),
+			"<a href=\"<!query q | escape>\">x</a>",
+			"<a href=\"#ZhtexZ\">x</a>",
+			[]ElemKind{ElemText, ElemQuery, ElemText},
+		},
+		{
+			q("a&b\\"),
+			"<script>var s = \"<!query q | escape>\";</script><p><!query q | escape></p><!query-raw q | escape>",
+			"<script>var s = \"a\\u0026b\\\\\";</script><p>a&amp;b\\</p>a&amp;b\\",
+			[]ElemKind{ElemText, ElemQuery, ElemText, ElemQuery, ElemText, ElemQuery},
+		},
+		{
+			q("<img src=x onerror=alert(1)> [x](javascript:alert(1))"),
+			"<!query q | markdown>",
+			"<p>&lt;img src=x onerror=alert(1)&gt; <tt>x</tt></p>\n",
+			[]ElemKind{ElemQuery},
+		},
+		{
+			q("<script>alert(1)</script>"),
+			"<!query q | markdown>",
+			"<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>\n",
+			[]ElemKind{ElemQuery},
+		},
+	}
+	h := NewHtex(".", false)
+	testParsing(h, t, tests)
+}
+
+func TestFilters(t *testing.T) {
+	tests := []ParseTest{
+		{
+			"GET /",
+			"<!set s \"  Hello World  \"><!get s | trim | upper>,<!get s|trim|lower>,<!get s | trim | slugify>",
+			"HELLO WORLD,hello world,hello-world",
+			[]ElemKind{ElemSet, ElemGet, ElemText, ElemGet, ElemText, ElemGet},
+		},
+		{
+			"GET /",
+			"<!set s \"the quick fox\"><!get s | title>,<!get s | truncate 5>,<!get s | truncate 5 \"…\">,<!get s | truncate 20>",
+			"The Quick Fox,the q...,the q…,the quick fox",
+			[]ElemKind{ElemSet, ElemGet, ElemText, ElemGet, ElemText, ElemGet, ElemText, ElemGet},
+		},
+		{
+			"GET /?n=1e30&m=Inf",
+			"<!set s abc><!get-raw s | truncate query(n)>,<!get s | truncate -query(n)>,<!get s | truncate -1>,<!get s | truncate query(m)>.",
+			"abc,...,...,.",
+			[]ElemKind{ElemSet, ElemGet, ElemText, ElemGet, ElemText, ElemGet, ElemText, ElemGet, ElemText},
+		},
+		{
+			"GET /?n=1e9",
+			"<!set x 1.5><!get x | number query(n)>,<!get x | number -1>",
+			"1.50000000000000000000,2",
+			[]ElemKind{ElemSet, ElemGet, ElemText, ElemGet},
+		},
+		{
+			"GET /?name=",
+			"<!get missing | default \"none\">,<!query name | default (query(x) + \"?\")>,<!data a | default 0>",
+			"none,?,0",
+			[]ElemKind{ElemGet, ElemText, ElemQuery, ElemText, ElemData},
+		},
+		{
+			"GET /",
+			"<!set n 1234567.891><!get n | number>,<!get n | number 2>,<!get n | number 0>,<!set m \"-1000\"><!get m | number 1>",
+			"1,234,567.891,1,234,567.89,1,234,568,-1,000.0",
+			[]ElemKind{ElemSet, ElemGet, ElemText, ElemGet, ElemText, ElemGet, ElemText, ElemSet, ElemGet},
+		},
+		{
+			"GET /",
+			"<!set d \"2024-03-05T10:20:30Z\"><!get d | date>,<!get d | date \"Jan 2, 2006\">,<!get d | date \"rfc1123\">",
+			"2024-03-05,Mar 5, 2024,Tue, 05 Mar 2024 10:20:30 +0000",
+			[]ElemKind{ElemSet, ElemGet, ElemText, ElemGet, ElemText, ElemGet},
+		},
+		{
+			"GET /?q=a%20b%26c",
+			"<!query q | urlencode>,<!set h \"<b>\"><!get h | escape>,<!get h | raw>,<!get h>",
+			"a+b%26c,&lt;b&gt;,<b>,&lt;b&gt;",
+			[]ElemKind{ElemQuery, ElemText, ElemSet, ElemGet, ElemText, ElemGet, ElemText, ElemGet},
+		},
+		{
+			"GET /",
+			"<!set s \"*hi*\"><!get s | markdown>",
+			"<p><em>hi</em></p>\n",
+			[]ElemKind{ElemSet, ElemGet},
+		},
+		{
+			"GET /",
+			"<!set l a \"b'c\"><script>var l = <!get l | json>;</script><div data-l=\"<!get l | json>\"></div>",
+			"<script>var l = [\"a\",\"b\\u0027c\"];</script><div data-l=\"[&#34;a&#34;,&#34;b&#39;c&#34;]\"></div>",
+			[]ElemKind{ElemSet, ElemText, ElemGet, ElemText, ElemGet, ElemText},
+		},
+		{
+			"GET /docs/",
+			"<!url | upper><!get x | shout>",
+			"/DOCS!",
+			[]ElemKind{ElemUrl, ElemGet},
+		},
+	}
+	h := NewHtex(".", false)
+	h.RegisterFilter("shout", func(value any, args []any) (any, error) {
+		return toString(value) + "!", nil
+	})
+	testParsing(h, t, tests)
+}
+
+func TestFilterErrors(t *testing.T) {
+	tests := []struct {
+		text string
+		err  string
+	}{
+		{
+			"<!get x | nope>",
+			"test.htex:1:11: <!get> unknown filter 'nope'\n\t<!get x | nope>\n\t          ^",
+		},
+		{
+			"<!get x | >",
+			"test.htex:1:11: <!get> expected filter name\n\t<!get x | >\n\t          ^",
+		},
+		{
+			"<!query q y>",
+			"test.htex:1:11: <!query> unexpected \"y\", expected '|'\n\t<!query q y>\n\t          ^",
+		},
+	}
+	h := NewHtex(".", false)
+	for _, test := range tests {
+		w := &memoryResponseWriter{hdr: http.Header{}}
+		r := &http.Request{Method: "GET"}
+		r.URL, _ = url.ParseRequestURI("/")
+		s := bufio.NewScanner(strings.NewReader(test.text))
+		_, err := h.parseHtexScanner(w, r, "test.htex", s)
+		if err == nil {
+			t.Errorf("parsing '%s' should fail", test.text)
+		} else if err.Error() != test.err {
+			t.Errorf("parsing '%s' error:\n%v\n(expected)\n%s", test.text, err, test.err)
+		}
+	}
+}
+
+func TestCustomElements(t *testing.T) {
+	tests := []ParseTest{
+		{
+			"GET /?name=%22%3Cb%3E",
+			"<p><!hello></p><input value=\"<!hello>\">",
+			"<p>hello &#34;&lt;b&gt;</p><input value=\"hello &#34;&lt;b&gt;\">",
+			[]ElemKind{ElemText, ElemCustom, ElemText, ElemCustom, ElemText},
+		},
+		{
+			"GET /",
+			"<!counter n 3><!get n>,<!get n | number 1>",
+			"3,3.0",
+			[]ElemKind{ElemCustom, ElemGet, ElemText, ElemGet},
+		},
+		{
+			"GET /?beta=1",
+			"a<!feature beta>b<!end>c<!feature other>d<!end>e",
+			"abce",
+			[]ElemKind{ElemText, ElemCustom, ElemText, ElemEnd, ElemText, ElemCustom, ElemText, ElemEnd, ElemText},
+		},
+		{
+			"GET /",
+			"<!repeat 3>x<!end>",
+			"xxx",
+			[]ElemKind{ElemCustom, ElemText, ElemEnd},
+		},
+	}
+	h := NewHtex(".", false)
+	h.RegisterElement("hello",
+		func(args string) (any, error) {
+			return nil, nil
+		},
+		func(ctx *ElementContext, data any) error {
+			ctx.Print("hello " + ctx.Request.URL.Query().Get("name"))
+			return nil
+		})
+	h.RegisterElement("counter",
+		func(args string) (any, error) {
+			name, n, _ := strings.Cut(args, " ")
+			return []string{name, n}, nil
+		},
+		func(ctx *ElementContext, data any) error {
+			args := data.([]string)
+			n, err := strconv.Atoi(args[1])
+			ctx.Set(args[0], n)
+			return err
+		})
+	h.RegisterBlockElement("feature",
+		func(args string) (any, error) {
+			return args, nil
+		},
+		func(ctx *ElementContext, data any) error {
+			if ctx.Request.URL.Query().Has(data.(string)) {
+				ctx.Content()
+			}
+			return nil
+		})
+	h.RegisterBlockElement("repeat",
+		func(args string) (any, error) {
+			return strconv.Atoi(args)
+		},
+		func(ctx *ElementContext, data any) error {
+			for i := 0; i < data.(int); i++ {
+				ctx.Content()
+			}
+			return nil
+		})
+	testParsing(h, t, tests)
+
+	// Errors returned by the parse function
+	h.RegisterElement("fail",
+		func(args string) (any, error) {
+			return nil, fmt.Errorf("invalid args '%s'", args)
+		},
+		func(ctx *ElementContext, data any) error { return nil })
+	w := &memoryResponseWriter{hdr: http.Header{}}
+	r := &http.Request{Method: "GET"}
+	r.URL, _ = url.ParseRequestURI("/")
+	s := bufio.NewScanner(strings.NewReader("a\n<!fail x y>"))
+	_, err := h.parseHtexScanner(w, r, "test.htex", s)
+	expected := "test.htex:2:1: <!fail> invalid args 'x y'\n\t<!fail x y>\n\t^"
+	if err == nil || err.Error() != expected {
+		t.Errorf("parsing custom element error:\n%v\n(expected)\n%s", err, expected)
+	}
+
+	// Names are case-insensitive
+	h.RegisterElement("myElem",
+		func(args string) (any, error) { return nil, nil },
+		func(ctx *ElementContext, data any) error {
+			ctx.Writer.Write([]byte("my"))
+			return nil
+		})
+	testParsing(h, t, []ParseTest{
+		{"GET /", "<!myelem>,<!MyElem>", "my,my", []ElemKind{ElemCustom, ElemText, ElemCustom}},
+	})
+
+	// Built-in, duplicated, and invalid names cannot be registered
+	parse := func(args string) (any, error) { return nil, nil }
+	render := func(ctx *ElementContext, data any) error { return nil }
+	for _, name := range append(slices.Clone(builtinElements), "Get", "hello", "MYELEM", "", "a b", "a.b") {
+		if err := h.RegisterElement(name, parse, render); err == nil {
+			t.Errorf("registering element '%s' should fail", name)
+		}
+	}
+
+	// Both functions are needed
+	if err := h.RegisterElement("noparse", nil, render); err == nil {
+		t.Errorf("registering element without parse function should fail")
+	}
+	if err := h.RegisterBlockElement("norender", parse, nil); err == nil {
+		t.Errorf("registering element without render function should fail")
+	}
+	if _, ok := h.elements["noparse"]; ok {
+		t.Errorf("element without parse function was registered")
+	}
+}
+
+func TestCache(t *testing.T) {
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "index.htex")
+	layoutFn := filepath.Join(dir, "layout.htex")
+	os.WriteFile(fn, []byte("<!layout layout.htex>a"), 0644)
+	os.WriteFile(layoutFn, []byte("<b><!content></b>"), 0644)
+
+	h := NewHtex(dir, false)
+	get := func(expected string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if result := w.Body.String(); result != expected {
+			t.Errorf("GET / => '%s' (expected '%s')", result, expected)
+		}
+	}
+	checkStats := func(expected CacheStats) {
+		t.Helper()
+		if stats := h.CacheStats(); stats != expected {
+			t.Errorf("cache stats %+v (expected %+v)", stats, expected)
+		}
+	}
+
+	get("<b>a</b>")
+	checkStats(CacheStats{Hits: 0, Misses: 2, Invalidations: 0, Entries: 2})
+	get("<b>a</b>")
+	checkStats(CacheStats{Hits: 2, Misses: 2, Invalidations: 0, Entries: 2})
+
+	// Modified file
+	os.WriteFile(fn, []byte("<!layout layout.htex>abc"), 0644)
+	get("<b>abc</b>")
+	checkStats(CacheStats{Hits: 3, Misses: 3, Invalidations: 1, Entries: 2})
+
+	// Deleted layout
+	os.Remove(layoutFn)
+	get("500 internal error\n")
+	checkStats(CacheStats{Hits: 4, Misses: 3, Invalidations: 2, Entries: 1})
+
+	// Concurrent requests
+	os.WriteFile(layoutFn, []byte("<i><!content></i>"), 0644)
+	done := make(chan bool)
+	for i := 0; i < 8; i++ {
+		go func() {
+			for j := 0; j < 10; j++ {
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+				if w.Body.String() != "<i>abc</i>" {
+					t.Errorf("GET / => '%s'", w.Body.String())
+				}
+			}
+			done <- true
+		}()
+	}
+	for i := 0; i < 8; i++ {
+		<-done
+	}
+
+	// Disabled cache
+	h = NewHtex(dir, false)
+	h.DisableCache = true
+	get("<i>abc</i>")
+	get("<i>abc</i>")
+	checkStats(CacheStats{})
+}
+
+func TestHtexFS(t *testing.T) {
+	theme := fstest.MapFS{
+		"layout.htex": {Data: []byte("<main><!content></main>")},
+		"style.css":   {Data: []byte("theme")},
+		"404.htex":    {Data: []byte("<!layout /layout.htex>not found")},
+	}
+	site := fstest.MapFS{
+		"index.htex":      {Data: []byte("<!layout layout.htex><!data-file d /data/site.json><!get d.title>")},
+		"docs/index.htex": {Data: []byte("<!layout ../layout.htex><!include-raw intro.html>")},
+		"docs/intro.html": {Data: []byte("<p>intro</p>")},
+		"data/site.json":  {Data: []byte(`{"title": "htex"}`)},
+		"style.css":       {Data: []byte("site")},
+		".git/config":     {Data: []byte("secret")},
+	}
+	h := NewHtexFS(NewOverlayFS(site, theme), false)
+
+	tests := []struct {
+		urlPath  string
+		code     int
+		expected string
+	}{
+		{"/", http.StatusOK, "<main>htex</main>"},
+		{"/docs/", http.StatusOK, "<main><p>intro</p></main>"},
+		{"/docs/intro.html", http.StatusOK, "<p>intro</p>"},
+		{"/style.css", http.StatusOK, "site"},
+		{"/nope", http.StatusNotFound, "<main>not found</main>"},
+		{"/.git/config", http.StatusNotFound, "<main>not found</main>"},
+		{"/../htex.go", http.StatusNotFound, "<main>not found</main>"},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", test.urlPath, nil))
+		if w.Code != test.code || w.Body.String() != test.expected {
+			t.Errorf("GET %s => %d '%s' (expected %d '%s')", test.urlPath, w.Code, w.Body.String(), test.code, test.expected)
+		}
+	}
+
+	// Scan files of all layers
+	var files []string
+	h.ScanFiles(
+		func(fullFn, query string) {
+			files = append(files, "dynamic "+query)
+		},
+		func(fullFn, fn string) {
+			files = append(files, "static "+fn)
+		})
+	expected := []string{
+		"dynamic /404",
+		"static /data/site.json",
+		"dynamic /docs/",
+		"static /docs/intro.html",
+		"dynamic /",
+		"dynamic /layout",
+		"static /style.css",
+	}
+	if !slices.Equal(files, expected) {
+		t.Errorf("scanned files %v (expected %v)", files, expected)
+	}
+
+	// Files outside the root directory cannot be accessed
+	h = NewHtex(filepath.Join(t.TempDir(), "public"), false)
+	if _, err := h.readFile(filepath.Join(h.localRoot, "../secret")); err == nil {
+		t.Errorf("file outside the root directory can be read")
+	}
+}
+
+func TestLiveReload(t *testing.T) {
+	fsys := fstest.MapFS{
+		"index.htex": {Data: []byte("<html><body>a</BODY></html>")},
+		"part.htex":  {Data: []byte("b")},
+		"json.htex":  {Data: []byte("<!content-type json>{}")},
+		"style.css":  {Data: []byte("body{}")},
+	}
+	h := NewHtexFS(fsys, false)
+	h.EnableLiveReload(time.Hour)
+
+	// Injected script
+	tests := []struct {
+		urlPath  string
+		expected string
+	}{
+		{"/", "<html><body>a" + liveReloadScript + "</BODY></html>"},
+		{"/part", "b" + liveReloadScript},
+		{"/json", "{}"},
+		{"/style.css", "body{}"},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", test.urlPath, nil))
+		if result := w.Body.String(); result != test.expected {
+			t.Errorf("GET %s => '%s' (expected '%s')", test.urlPath, result, test.expected)
+		}
+	}
+
+	// Detect modified files
+	files := h.snapshotFiles()
+	fsys["style.css"] = &fstest.MapFile{Data: []byte("body{color:red}")}
+	fsys[".git/config"] = &fstest.MapFile{Data: []byte("x")}
+	changed := changedFiles(files, h.snapshotFiles())
+	if !slices.Equal(changed, []string{"style.css"}) || reloadMessage(changed) != "css" {
+		t.Errorf("changed files %v (expected [style.css])", changed)
+	}
+	files = h.snapshotFiles()
+	fsys[".includes/header.htex"] = &fstest.MapFile{Data: []byte("h")}
+	changed = changedFiles(files, h.snapshotFiles())
+	if !slices.Equal(changed, []string{".includes/header.htex"}) || reloadMessage(changed) != "reload" {
+		t.Errorf("changed files %v (expected [.includes/header.htex])", changed)
+	}
+	files = h.snapshotFiles()
+	delete(fsys, "part.htex")
+	changed = changedFiles(files, h.snapshotFiles())
+	if !slices.Equal(changed, []string{"part.htex"}) || reloadMessage(changed) != "reload" {
+		t.Errorf("changed files %v (expected [part.htex])", changed)
+	}
+
+	// Server-Sent Events
+	server := httptest.NewServer(h)
+	defer server.Close()
+	resp, err := http.Get(server.URL + liveReloadUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if contentType := resp.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Errorf("content type '%s' (expected 'text/event-stream')", contentType)
+	}
+	h.liveReload.broadcast("reload")
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil || line != "data: reload\n" {
+		t.Errorf("event '%s' (expected 'data: reload')", line)
+	}
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "index.htex"), []byte("<!wait>ok"), 0644)
+	h := NewHtex(dir, false)
+	started := make(chan bool)
+	release := make(chan bool)
+	h.RegisterElement("wait",
+		func(args string) (any, error) { return nil, nil },
+		func(ctx *ElementContext, data any) error {
+			started <- true
+			<-release
+			return nil
+		})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error)
+	go func() {
+		result <- h.RunWebServerContext(ctx, port, "", "")
+	}()
+
+	// Wait until the server is listening
+	response := make(chan *http.Response)
+	go func() {
+		for {
+			resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/", port))
+			if err == nil {
+				response <- resp
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	// Stop the server with an active request
+	<-started
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	release <- true
+	resp := <-response
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "ok" {
+		t.Errorf("active request => %d '%s' (expected 200 'ok')", resp.StatusCode, body)
+	}
+	if err := <-result; err != nil {
+		t.Errorf("server returned an error: %v", err)
+	}
+
+	// Live reload connections don't delay the shutdown
+	h = NewHtex(dir, false)
+	h.EnableLiveReload(time.Hour)
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		result <- h.RunWebServerContext(ctx, port, "", "")
+	}()
+	var events *http.Response
+	for events == nil {
+		events, _ = http.Get(fmt.Sprintf("http://127.0.0.1:%d%s", port, liveReloadUrl))
+		time.Sleep(10 * time.Millisecond)
+	}
+	defer events.Body.Close()
+	start := time.Now()
+	cancel()
+	if err := <-result; err != nil {
+		t.Errorf("server with live reload returned an error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("server with live reload stopped after %v", elapsed)
+	}
+
+	// Errors are returned instead of exiting the program
+	h = NewHtex(filepath.Join(dir, "nope"), false)
+	if err := h.RunWebServerContext(context.Background(), port, "", ""); err == nil {
+		t.Errorf("server started with an invalid directory")
+	}
+}
+
+func TestConfig(t *testing.T) {
+	dir := t.TempDir()
+	configFn := filepath.Join(dir, "htex.toml")
+	os.WriteFile(configFn, []byte(`
+root = "site"
+
+[server]
+port = 8080
+read_timeout = "5s"
+
+[vars]
+site = { title = "Site", year = 2025 }
+
+[[redirects]]
+from = "/old/*"
+to = "/new/*"
+
+[[redirects]]
+from = "/blog"
+to = "https://blog.example.com/"
+code = 302
+
+[[headers]]
+path = "/*"
+values = { X-Frame-Options = "DENY" }
+
+[exec]
+disable = true
+
+[markdown]
+target_blank = false
+`), 0644)
+	root := filepath.Join(dir, "site")
+	os.Mkdir(root, 0755)
+	os.WriteFile(filepath.Join(root, "index.htex"), []byte("<!get site.title> <!get site.year><!exec echo a>"), 0644)
+	os.WriteFile(filepath.Join(root, "md.htex"), []byte("<!include-markdown a.md>"), 0644)
+	os.WriteFile(filepath.Join(root, "footer.htex"), []byte("<footer><!get site.title></footer>"), 0644)
+	os.WriteFile(filepath.Join(root, "comp.htex"), []byte(
+		"<!define title><h1><!get site.title></h1><!end><!call title><!call footer.htex><!wrap footer.htex>x<!end>"), 0644)
+	os.WriteFile(filepath.Join(root, "a.md"), []byte("[a](/a)"), 0644)
+
+	if FindConfigFile(dir) != configFn {
+		t.Errorf("config file '%s' not found", configFn)
+	}
+	cfg := DefaultConfig()
+	if err := LoadConfig(configFn, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Root != root || cfg.Gen.Output != filepath.Join(dir, "output") {
+		t.Errorf("root '%s' and output '%s' are not relative to the config file", cfg.Root, cfg.Gen.Output)
+	}
+	if cfg.Server.Port != 8080 || cfg.Server.ReadTimeout != Duration(5*time.Second) ||
+		cfg.Server.WriteTimeout != Duration(DefaultServerConfig.WriteTimeout) {
+		t.Errorf("invalid server options %+v", cfg.Server)
+	}
+
+	h := NewHtex(cfg.Root, false)
+	h.ApplyConfig(&cfg)
+	tests := []struct {
+		urlPath  string
+		code     int
+		expected string
+		location string
+	}{
+		{"/", http.StatusOK, "Site 2025<!-- exec error -->", ""},
+		{"/md", http.StatusOK, "<p><a href=\"/a\">a</a></p>\n", ""},
+		{"/comp", http.StatusOK, "<h1>Site</h1><footer>Site</footer><footer>Site</footer>", ""},
+		{"/old/a/b", http.StatusMovedPermanently, "", "/new/a/b"},
+		{"/blog/", http.StatusFound, "", "https://blog.example.com/"},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", test.urlPath, nil))
+		if w.Code != test.code ||
+			(test.expected != "" && w.Body.String() != test.expected) ||
+			w.Header().Get("Location") != test.location {
+			t.Errorf("GET %s => %d '%s' %s (expected %d '%s' %s)", test.urlPath,
+				w.Code, w.Body.String(), w.Header().Get("Location"),
+				test.code, test.expected, test.location)
+		}
+		if w.Header().Get("X-Frame-Options") != "DENY" {
+			t.Errorf("GET %s without X-Frame-Options header", test.urlPath)
+		}
+	}
+
+	// Invalid files
+	tests2 := []struct {
+		fn      string
+		content string
+		err     string
+	}{
+		{"a.toml", "port = 80", "unknown option 'port'"},
+		{"b.json", `{"server": {"prot": 80}}`, `unknown field "prot"`},
+		{"c.toml", "[[redirects]]\nfrom = \"/a\"", "redirects need 'from' and 'to' options"},
+		{"d.toml", "[[redirects]]\nfrom = \"/a\"\nto = \"/b\"\ncode = 200", "invalid redirect code 200"},
+		{"e.toml", "[server]\nidle_timeout = \"1\"", "missing unit"},
+		{"f.toml", "[markdown]\nextensions = [\"emoji\"]", "unknown markdown extension 'emoji'"},
+	}
+	for _, test := range tests2 {
+		fn := filepath.Join(dir, test.fn)
+		os.WriteFile(fn, []byte(test.content), 0644)
+		cfg := DefaultConfig()
+		err := LoadConfig(fn, &cfg)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("loading '%s' returned error '%v' (expected '%s')", test.content, err, test.err)
+		}
+	}
+}
+
+func TestMarkdownPages(t *testing.T) {
+	fsys := fstest.MapFS{
+		"layout.htex":     {Data: []byte("<!set title Site><!set author nobody><title><!get title></title><!get date><!get author><main><!content></main>")},
+		"index.md":        {Data: []byte("---\nlayout: /layout.htex\ntitle: Home\nauthor: \"<b>\"\n---\n# Hi\n")},
+		"docs/intro.md":   {Data: []byte("+++\nlayout = \"../layout.htex\"\ntitle = \"Intro\"\ndate = 2025-03-01\n+++\ntext")},
+		"docs/draft.md":   {Data: []byte("---\ndraft: true\n---\ndraft")},
+		"docs/bare.md":    {Data: []byte("a *b*")},
+		"docs/bad.md":     {Data: []byte("---\ntitle: a\n")},
+		"docs/index.htex": {Data: []byte("<!include-markdown intro.md>")},
+		"page.htex":       {Data: []byte("htex")},
+		"page.md":         {Data: []byte("markdown")},
+	}
+	h := NewHtexFS(fsys, false)
+
+	tests := []struct {
+		urlPath  string
+		code     int
+		expected string
+	}{
+		{"/", http.StatusOK, "<title>Home</title>&lt;b&gt;<main><h1 id=\"hi\">Hi</h1>\n</main>"},
+		{"/docs/intro", http.StatusOK, "<title>Intro</title>2025-03-01T00:00:00Znobody<main><p>text</p>\n</main>"},
+		{"/docs/", http.StatusOK, "<p>text</p>\n"},
+		{"/docs/bare", http.StatusOK, "<p>a <em>b</em></p>\n"},
+		{"/docs/draft", http.StatusNotFound, "404 page not found\n"},
+		{"/docs/bad", http.StatusInternalServerError, "500 internal error\n"},
+		{"/page", http.StatusOK, "htex"},
+		{"/docs/intro.md", http.StatusNotFound, "404 page not found\n"},
+		{"/docs/draft.md", http.StatusNotFound, "404 page not found\n"},
+		{"/page.md", http.StatusNotFound, "404 page not found\n"},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", test.urlPath, nil))
+		if w.Code != test.code || w.Body.String() != test.expected {
+			t.Errorf("GET %s => %d '%s' (expected %d '%s')", test.urlPath, w.Code, w.Body.String(), test.code, test.expected)
+		}
+	}
+
+	// Drafts can be published
+	h.Drafts = true
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/docs/draft", nil))
+	if w.Body.String() != "<p>draft</p>\n" {
+		t.Errorf("GET /docs/draft => '%s' (expected '<p>draft</p>\\n')", w.Body.String())
+	}
+
+	// Markdown pages are routes
+	var queries []string
+	h.ScanFiles(
+		func(fullFn, query string) {
+			queries = append(queries, query)
+		},
+		func(fullFn, fn string) {})
+	expected := []string{"/docs/bad", "/docs/bare", "/docs/draft", "/docs/", "/docs/intro", "/", "/layout", "/page"}
+	if !slices.Equal(queries, expected) {
+		t.Errorf("scanned routes %v (expected %v)", queries, expected)
+	}
+}
+
+func TestMarkdownOptions(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.md":      {Data: []byte("# Title\n\n[b](b.md#x) \"c\"\nd ![i](i.png)")},
+		"note.md":   {Data: []byte("a[^1]\n\n[^1]: b")},
+		"header.md": {Data: []byte("## Custom {#id}\n## Auto")},
+	}
+	tests := []struct {
+		text     string
+		expected string
+	}{
+		{"<!include-markdown a.md>",
+			"<h1 id=\"title\">Title</h1>\n\n<p><a href=\"b.md#x\" target=\"_blank\">b</a> &ldquo;c&rdquo;\nd <img src=\"i.png\" alt=\"i\" /></p>\n"},
+		{"<!include-markdown a.md target-blank=false smart-punctuation=false hard-line-breaks md-links>",
+			"<h1 id=\"title\">Title</h1>\n\n<p><a href=\"b#x\">b</a> &quot;c&quot;<br>\nd <img src=\"i.png\" alt=\"i\" /></p>\n"},
+		{"<!include-markdown a.md heading-ids=none>",
+			"<h1>Title</h1>\n\n<p><a href=\"b.md#x\" target=\"_blank\">b</a> &ldquo;c&rdquo;\nd <img src=\"i.png\" alt=\"i\" /></p>\n"},
+		{"<!include-markdown header.md heading-ids=custom heading-id-prefix=\"doc-\">",
+			"<h2 id=\"doc-id\">Custom</h2>\n\n<h2>Auto</h2>\n"},
+		{"<!include-markdown note.md footnotes>",
+			"<p>a<sup class=\"footnote-ref\" id=\"fnref:1\"><a href=\"#fn:1\">1</a></sup></p>\n\n<div class=\"footnotes\">\n\n<hr>\n\n<ol>\n<li id=\"fn:1\">b <a class=\"footnote-return\" href=\"#fnref:1\"><sup>[return]</sup></a></li>\n</ol>\n\n</div>\n"},
+		{"<!include-markdown note.md extensions=\"tables,autolink\">",
+			"<p>a<a href=\"b\" target=\"_blank\">^1</a></p>\n"},
+	}
+	h := NewHtexFS(fsys, false)
+	h.DisableCache = true
+	get := func(text, expected string) {
+		t.Helper()
+		fsys["page.htex"] = &fstest.MapFile{Data: []byte(text)}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/page", nil))
+		if result := w.Body.String(); result != expected {
+			t.Errorf("parsing '%s' => '%s' (expected '%s')", text, result, expected)
+		}
+	}
+	for _, test := range tests {
+		get(test.text, test.expected)
+	}
+
+	// Options of the server and link hooks
+	h.Markdown.TargetBlank = false
+	h.Markdown.MdLinks = true
+	h.Markdown.LinkHook = func(dest string, image bool) string {
+		if image {
+			return "/img/" + dest
+		}
+		return dest
+	}
+	get("<!include-markdown a.md>",
+		"<h1 id=\"title\">Title</h1>\n\n<p><a href=\"b#x\">b</a> &ldquo;c&rdquo;\nd <img src=\"/img/i.png\" alt=\"i\" /></p>\n")
+
+	// Invalid options
+	for _, text := range []string{
+		"<!include-markdown a.md target-blank=maybe>",
+		"<!include-markdown a.md colors=true>",
+		"<!include-markdown a.md extensions=emoji>",
+		"<!include-markdown a.md heading-ids=github>",
+	} {
+		s := bufio.NewScanner(strings.NewReader(text))
+		if _, err := h.parseHtexScanner(nil, nil, "/test.htex", s); err == nil {
+			t.Errorf("parsing '%s' should fail", text)
+		}
+	}
+}
+
+func TestExecPolicy(t *testing.T) {
+	dir := t.TempDir()
+	binDir := filepath.Join(dir, "bin")
+	os.Mkdir(binDir, 0755)
+	os.WriteFile(filepath.Join(binDir, "hello"), []byte("#!/bin/sh\necho \"<hello $1>\"\n"), 0755)
+	t.Setenv("HTEX_PUBLIC", "a")
+	t.Setenv("HTEX_SECRET", "b")
+
+	tests := []struct {
+		policy   ExecPolicy
+		text     string
+		expected string
+	}{
+		{ExecPolicy{}, "<!exec echo a&b>", "a&amp;b\n"},
+		{ExecPolicy{Disable: true, Placeholder: "[{error}]"}, "<!exec echo a>", "[&lt;!exec&gt; is disabled]"},
+		{ExecPolicy{Allow: []string{"echo"}}, "<!exec echo a>", "a\n"},
+		{ExecPolicy{Allow: []string{"echo"}, Placeholder: "{error}"}, "<!exec ls>", "command &#39;ls&#39; is not allowed"},
+		{ExecPolicy{BinDir: binDir}, "<!exec hello world>", "&lt;hello world&gt;\n"},
+		{ExecPolicy{BinDir: binDir, Placeholder: "-"}, "<!exec echo a>", "-"},
+		{ExecPolicy{BinDir: binDir, Placeholder: "-"}, "<!exec ../bin/hello>", "-"},
+		{ExecPolicy{Timeout: Duration(50 * time.Millisecond), Placeholder: "{error}"}, "<!exec sleep 5>", "&#39;sleep&#39; timed out after 50ms"},
+		{ExecPolicy{Timeout: Duration(50 * time.Millisecond), Timeouts: map[string]Duration{"sleep": Duration(5 * time.Second)}}, "<!exec sleep 0.1>", ""},
+		{ExecPolicy{MaxOutput: 10, Placeholder: "{error}"}, "<!exec yes>", "output of &#39;yes&#39; exceeds 10 bytes"},
+		{ExecPolicy{MaxOutput: 10}, "<!exec echo 123456789>", "123456789\n"},
+		{ExecPolicy{Env: []string{"HTEX_PUBLIC"}}, "<!exec printenv HTEX_PUBLIC>", "a\n"},
+		{ExecPolicy{Env: []string{"HTEX_PUBLIC"}, Placeholder: "-"}, "<!exec printenv HTEX_SECRET>", "-"},
+	}
+	for _, test := range tests {
+		os.WriteFile(filepath.Join(dir, "index.htex"), []byte(test.text), 0644)
+		h := NewHtex(dir, false)
+		h.Exec = test.policy
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if result := w.Body.String(); result != test.expected {
+			t.Errorf("exec '%s' with %+v => '%s' (expected '%s')", test.text, test.policy, result, test.expected)
+		}
+	}
+}
+
+func TestExecTimeout(t *testing.T) {
+	dir := t.TempDir()
+	tests := []string{
+		// The grandchild process keeps the output open
+		`<!exec sh -c "sleep 3; echo x">`,
+		`<!exec sh -c "(sleep 3; echo x) & wait">`,
+		// The grandchild process is in other process group
+		`<!exec sh -c "setsid sleep 3">`,
+	}
+	for _, text := range tests {
+		os.WriteFile(filepath.Join(dir, "index.htex"), []byte(text), 0644)
+		h := NewHtex(dir, false)
+		h.Exec = ExecPolicy{Timeout: Duration(200 * time.Millisecond), Placeholder: "{error}"}
+		w := httptest.NewRecorder()
+		start := time.Now()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("exec '%s' took %v", text, elapsed)
+		}
+		expected := "&#39;sh&#39; timed out after 200ms"
+		if result := w.Body.String(); result != expected {
+			t.Errorf("exec '%s' => '%s' (expected '%s')", text, result, expected)
+		}
+	}
+}
+
+func TestExecRequest(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "index.htex"), []byte("<!exec-raw sh env.sh>|<!exec sh env.sh>"), 0644)
+	os.WriteFile(filepath.Join(dir, "env.sh"), []byte(`printf '<b>%s %s %s %s %s %s %s %s %s</b>' "$REQUEST_METHOD" "$SCRIPT_NAME" "$QUERY_STRING" "$CONTENT_TYPE" "$HTTP_X_TOKEN" "$HTTP_PROXY" "$HTEX_QUERY_USER_ID" "$HTEX_FORM_MSG" "$REMOTE_ADDR"
+cat
+`), 0644)
+	h := NewHtex(dir, false)
+	h.Exec.Stdin = true
+
+	tests := []struct {
+		method      string
+		target      string
+		contentType string
+		body        string
+		expected    string
+	}{
+		{"GET", "/?user-id=5", "", "",
+			"<b>GET / user-id=5    5  192.0.2.1</b>|&lt;b&gt;GET / user-id=5    5  192.0.2.1&lt;/b&gt;"},
+		{"POST", "/?a=b", "application/x-www-form-urlencoded", "msg=hi+there",
+			"<b>POST / a=b application/x-www-form-urlencoded tok   hi there 192.0.2.1</b>msg=hi+there|" +
+				"&lt;b&gt;POST / a=b application/x-www-form-urlencoded tok   hi there 192.0.2.1&lt;/b&gt;msg=hi+there"},
+		{"PUT", "/", "application/json", `{"a":1}`,
+			`<b>PUT /  application/json tok    192.0.2.1</b>{"a":1}|` +
+				`&lt;b&gt;PUT /  application/json tok    192.0.2.1&lt;/b&gt;{&#34;a&#34;:1}`},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.target, strings.NewReader(test.body))
+		if test.contentType != "" {
+			r.Header.Set("Content-Type", test.contentType)
+			r.Header.Set("X-Token", "tok")
+			r.Header.Set("Proxy", "evil")
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if result := w.Body.String(); result != test.expected {
+			t.Errorf("%s %s => '%s' (expected '%s')", test.method, test.target, result, test.expected)
+		}
+	}
+
+	// Body too big
+	h.Exec.MaxStdin = 4
+	h.Exec.Placeholder = "{error}"
+	r := httptest.NewRequest("PUT", "/", strings.NewReader("12345"))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if expected := "request body exceeds 4 bytes|request body exceeds 4 bytes"; w.Body.String() != expected {
+		t.Errorf("PUT / => '%s' (expected '%s')", w.Body.String(), expected)
+	}
+}
+
+func TestExecArgs(t *testing.T) {
+	tests := []struct {
+		text     string
+		expected []string
+	}{
+		{`git log --format="%h %s" -n 5`, []string{"git", "log", "--format=%h %s", "-n", "5"}},
+		{`echo 'a  b' c\ d "" '' "\"x\" \$y \z"`, []string{"echo", "a  b", "c d", "", "", `"x" $y \z`}},
+		{`echo a=b a|b (a) $ "$" a$`, []string{"echo", "a=b", "a|b", "(a)", "$", "$", "a$"}},
+	}
+	for _, test := range tests {
+		args, err := parseCommand(test.text)
+		if err != nil {
+			t.Errorf("parsing '%s': %v", test.text, err)
+			continue
+		}
+		var result []string
+		for _, arg := range args {
+			result = append(result, arg.eval(nil))
+		}
+		if !slices.Equal(result, test.expected) {
+			t.Errorf("parsing '%s' => %q (expected %q)", test.text, result, test.expected)
+		}
+	}
+
+	for _, text := range []string{`echo "a`, `echo 'a`, `echo ${a`, `echo ${a b}`, `$cmd a`, ``} {
+		if _, err := parseCommand(text); err == nil {
+			t.Errorf("parsing '%s' should fail", text)
+		}
+	}
+
+	// Variables are passed as one argument
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "index.htex"), []byte(
+		`<!set name "a b; rm -rf /"><!set user.id 7><!exec printf "[%s]" $name "x${name}y" '$name' ${user.id} ${query.q} ${form.f} $missing>`), 0644)
+	h := NewHtex(dir, false)
+	r := httptest.NewRequest("POST", "/?q=%22q%22", strings.NewReader("f=$(id)"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	expected := "[a b; rm -rf /][xa b; rm -rf /y][$name][7][&#34;q&#34;][$(id)][]"
+	if result := w.Body.String(); result != expected {
+		t.Errorf("exec with variables => '%s' (expected '%s')", result, expected)
+	}
+}
+
+// flushRecorder keeps the output sent to the client in each Flush()
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushes []string
+}
+
+func (f *flushRecorder) Flush() {
+	f.flushes = append(f.flushes, f.Body.String())
+}
+
+func TestStreaming(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "file.txt"), []byte("<file>"), 0644)
+	tests := []struct {
+		text     string
+		code     int
+		flushes  []string
+		expected string
+	}{
+		{"a<!exec printf b><!status 201>c", 201, nil, "abc"},
+		{"<!status 201>a<!flush><!status 500>b<!exec printf x<y>c<!include-escaped file.txt>",
+			201, []string{"a", "abx&lt;y"}, "abx&lt;yc&lt;file&gt;"},
+		{"<!flush><!exec-raw printf '<p>'><!flush><!include-raw file.txt>",
+			200, []string{"", "<p>", "<p>"}, "<p><file>"},
+		{"a<!flush><!exec sh -c \"echo b; exit 1\">",
+			200, []string{"a", "ab\n"}, "ab\n<!-- exec error -->"},
+	}
+	for _, test := range tests {
+		os.WriteFile(filepath.Join(dir, "index.htex"), []byte(test.text), 0644)
+		h := NewHtex(dir, false)
+		w := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if w.Code != test.code {
+			t.Errorf("streaming '%s' => status %d (expected %d)", test.text, w.Code, test.code)
+		}
+		if !slices.Equal(w.flushes, test.flushes) {
+			t.Errorf("streaming '%s' => flushes %q (expected %q)", test.text, w.flushes, test.flushes)
+		}
+		if result := w.Body.String(); result != test.expected {
+			t.Errorf("streaming '%s' => '%s' (expected '%s')", test.text, result, test.expected)
+		}
+	}
+
+	// The stream is terminated after MaxStreamDuration
+	os.WriteFile(filepath.Join(dir, "index.htex"), []byte("a<!flush><!exec sleep 5>b"), 0644)
+	h := NewHtex(dir, false)
+	h.Server.MaxStreamDuration = 100 * time.Millisecond
+	w := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	start := time.Now()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("stream not terminated after %v", elapsed)
+	}
+	if result := w.Body.String(); result != "a" {
+		t.Errorf("terminated stream => '%s' (expected 'a')", result)
+	}
+}
+
+func TestUploads(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "public")
+	uploadDir := filepath.Join(dir, "uploads")
+	os.Mkdir(root, 0755)
+	os.WriteFile(filepath.Join(root, "index.htex"), []byte(
+		`<!upload-save doc><!upload doc>|<!upload doc size>|<!upload doc type>|<!upload doc name | upper>|`+
+			`<!data title>|<!upload missing>|<!exec cat ${upload.doc}>|<!exec cat ${upload.other}>|<!exec echo -n ${upload.other}>`), 0644)
+
+	newRequest := func(files map[string]string) *http.Request {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		mw.WriteField("title", "<report>")
+		for _, name := range []string{"doc", "other"} {
+			if content, ok := files[name]; ok {
+				fw, _ := mw.CreateFormFile(name, "../"+name+" file.txt")
+				fw.Write([]byte(content))
+			}
+		}
+		mw.Close()
+		r := httptest.NewRequest("POST", "/", &body)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		return r
+	}
+
+	h := NewHtex(root, false)
+	h.Upload.Dir = uploadDir
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, newRequest(map[string]string{"doc": "doc content", "other": "other content"}))
+	parts := strings.Split(w.Body.String(), "|")
+	expected := []string{"doc file.txt", "11", "application/octet-stream", "DOC FILE.TXT",
+		"&lt;report&gt;", "", "doc content", "other content"}
+	if len(parts) != len(expected)+1 || !slices.Equal(parts[:len(expected)], expected) {
+		t.Fatalf("upload => %q (expected %q)", parts, expected)
+	}
+	if _, err := os.Stat(parts[len(expected)]); !os.IsNotExist(err) {
+		t.Errorf("temporary file %s was not deleted", parts[len(expected)])
+	}
+	entries, _ := os.ReadDir(uploadDir)
+	if len(entries) != 1 || !strings.HasSuffix(entries[0].Name(), "-doc_file.txt") {
+		t.Fatalf("saved files => %v", entries)
+	}
+	if content, _ := os.ReadFile(filepath.Join(uploadDir, entries[0].Name())); string(content) != "doc content" {
+		t.Errorf("saved file => '%s'", content)
+	}
+
+	// Size limit
+	h.Upload.MaxSize = 100
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, newRequest(map[string]string{"doc": strings.Repeat("x", 200)}))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("big upload => status %d (expected %d)", w.Code, http.StatusRequestEntityTooLarge)
+	}
+
+	// Uploads cannot be saved inside the root directory
+	h.Upload = UploadPolicy{Dir: filepath.Join(root, "uploads")}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, newRequest(map[string]string{"doc": "x"}))
+	if _, err := os.Stat(filepath.Join(root, "uploads")); !os.IsNotExist(err) {
+		t.Errorf("upload saved inside the root directory")
+	}
+	os.WriteFile(filepath.Join(dir, "htex.toml"), []byte("root = \"public\"\n[upload]\ndir = \"public/uploads\"\n"), 0644)
+	cfg := DefaultConfig()
+	if err := LoadConfig(filepath.Join(dir, "htex.toml"), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.checkDirs(); err == nil {
+		t.Errorf("upload directory inside the root directory should fail")
+	}
+
+	// The root directory can be changed with -root after loading
+	// the configuration file
+	os.WriteFile(filepath.Join(dir, "htex.toml"), []byte("root = \"public\"\n[upload]\ndir = \"uploads\"\n"), 0644)
+	cfg = DefaultConfig()
+	if err := LoadConfig(filepath.Join(dir, "htex.toml"), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.checkDirs(); err != nil {
+		t.Error(err)
+	}
+	cfg.Root = dir
+	if err := cfg.checkDirs(); err == nil {
+		t.Errorf("upload directory inside the -root directory should fail")
+	}
+}
@@ -7,6 +7,7 @@ package htex
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -26,14 +27,99 @@ const (
 	TokPClose // ')'
 )
 
+func (t Tok) String() string {
+	switch t {
+	case TokEof:
+		return "end of file"
+	case TokText:
+		return "text"
+	case TokElemBegin:
+		return "element"
+	case TokElemEnd:
+		return "'>'"
+	case TokOp:
+		return "operator"
+	case TokPOpen:
+		return "'('"
+	case TokPClose:
+		return "')'"
+	}
+	return "none"
+}
+
+// Pos is a position (line and column starting from 1) in a source
+// file.
+type Pos struct {
+	Fn   string
+	Line int
+	Col  int
+}
+
+func (p Pos) String() string {
+	return fmt.Sprintf("%s:%d:%d", p.Fn, p.Line, p.Col)
+}
+
 type Token struct {
 	kind      Tok
 	text      string
-	separated bool
+	separated bool // Whitespace found after this token
+	pos       Pos
 }
 
 type Tokens struct {
 	tokens []Token
+	source []byte
+}
+
+// ParseError is an error found in the source code of a .htex file.
+type ParseError struct {
+	Pos  Pos
+	Elem string // Element where the error was found, e.g. "<!if>"
+	Msg  string
+	Line string // Line of source code where the error was found
+}
+
+func (e *ParseError) Error() string {
+	var sb strings.Builder
+	sb.WriteString(e.Pos.String())
+	sb.WriteString(": ")
+	if e.Elem != "" {
+		sb.WriteString(e.Elem)
+		sb.WriteString(" ")
+	}
+	sb.WriteString(e.Msg)
+
+	// Show the line with a caret pointing to the column
+	if e.Line != "" {
+		sb.WriteString("\n\t")
+		sb.WriteString(e.Line)
+		sb.WriteString("\n\t")
+		for i := 0; i < e.Pos.Col-1 && i < len(e.Line); i++ {
+			if e.Line[i] == '\t' {
+				sb.WriteByte('\t')
+			} else {
+				sb.WriteByte(' ')
+			}
+		}
+		sb.WriteString("^")
+	}
+	return sb.String()
+}
+
+// errorAt creates a ParseError in the given position including the
+// source code line of that position.
+func (t *Tokens) errorAt(pos Pos, elem string, format string, args ...any) *ParseError {
+	var line string
+	lines := bytes.Split(t.source, []byte("\n"))
+	if pos.Line >= 1 && pos.Line <= len(lines) {
+		line = strings.TrimRight(string(lines[pos.Line-1]), "\r")
+	}
+	return &ParseError{
+		Pos:  pos,
+		Elem: elem,
+		Msg:  fmt.Sprintf(format, args...),
+		Line: line,
+	}
 }
 
 //////////////////////////////////////////////////////////////////////
@@ -59,17 +145,29 @@ func (ti *TokensIter) advance() bool {
 		ti.token = ti.tokens.tokens[ti.i]
 		return true
 	} else {
-		ti.token = Token{TokEof, "", false}
+		ti.token = Token{kind: TokEof, pos: ti.eofPos()}
 		return false
 	}
 }
 
+// eofPos returns the position of the last token.
+func (ti *TokensIter) eofPos() Pos {
+	if ti.n > 0 {
+		return ti.tokens.tokens[ti.n-1].pos
+	}
+	return Pos{}
+}
+
 func (ti *TokensIter) expectTok(expected Tok) error {
 	if ti.nextTok() == expected {
 		ti.advance()
 		return nil
 	}
-	return fmt.Errorf("expected token %v not found, %v found", expected, ti.nextTok())
+	pos := ti.eofPos()
+	if ti.i+1 < ti.n {
+		pos = ti.tokens.tokens[ti.i+1].pos
+	}
+	return ti.tokens.errorAt(pos, "", "expected %v, %v found", expected, ti.nextTok())
 }
 
 func newTokensIter(tokens *Tokens) *TokensIter {
@@ -101,6 +199,10 @@ func isAlphaNum(c byte) bool {
 		(c == '_') || (c == '-')
 }
 
+// errElemNotClosed is returned by the split function when an element
+// is not closed before an HTML comment.
+var errElemNotClosed = errors.New("element not closed")
+
 func splitTokens(l *Lexer) func([]byte, bool) (int, []byte, error) {
 	insideElem := false
 	insideComment := false
@@ -110,6 +212,7 @@ func splitTokens(l *Lexer) func([]byte, bool) (int, []byte, error) {
 	return func(data []byte, atEOF bool) (int, []byte, error) {
 		if closingElem {
 			closingElem = false
+			insideElem = false
 			return 1, data[0:1], nil
 		}
 		for i := 0; i < len(data); i++ {
@@ -120,7 +223,9 @@ func splitTokens(l *Lexer) func([]byte, bool) (int, []byte, error) {
 					for i++; i < len(data) && isSpace(data[i]); i++ {
 					}
 					if j == 0 {
-						return i, nil, nil // Only empty text
+						// Only empty text (we cannot return a nil
+						// token, or the scanner would stop at EOF)
+						return i, data[:0], nil
 					} else {
 						return i, data[:j], nil
 					}
@@ -131,6 +236,17 @@ func splitTokens(l *Lexer) func([]byte, bool) (int, []byte, error) {
 					insideElem = false
 					closingElem = false
 					return 1, data[0:1], nil
+				} else if i == 0 && (data[i] == '"' || data[i] == '\'') {
+					// Quoted string (it's kept as one token with the
+					// quotes included)
+					j := bytes.IndexByte(data[1:], data[0])
+					if j < 0 {
+						if !atEOF {
+							return 0, nil, nil
+						}
+						return len(data), data, nil
+					}
+					return j + 2, data[:j+2], nil
 				} else if data[i] == '(' {
 					if i > 0 {
 						return i, data[:i], nil
@@ -143,24 +259,33 @@ func splitTokens(l *Lexer) func([]byte, bool) (int, []byte, error) {
 					}
 					params--
 					return 1, data[0:1], nil
-				} else if i+1 < len(data) && data[i+1] == '=' {
+				} else if i+1 < len(data) && data[i+1] == '=' &&
+					(data[i] == '=' ||
+						data[i] == '!' ||
+						data[i] == '<' ||
+						data[i] == '>') {
 					if i > 0 {
 						return i, data[:i], nil
 					}
 					// Operators: ==, !=, <=, >=
-					if data[i] == '=' ||
-						data[i] == '!' ||
-						data[i] == '<' ||
-						data[i] == '>' {
-						return i + 2, data[:i+2], nil
-					}
+					return 2, data[:2], nil
 				} else if params > 0 &&
 					(data[i] == '<' || data[i] == '>') {
 					if i > 0 {
 						return i, data[:i], nil
 					}
 					return 1, data[0:1], nil
+				} else if (data[i] == '&' || data[i] == '|' || data[i] == '.') &&
+					i+1 < len(data) && data[i+1] == data[i] {
+					if i > 0 {
+						return i, data[:i], nil
+					}
+					// Operators: &&, ||, ..
+					return 2, data[:2], nil
 				} else if data[i] == '=' ||
+					data[i] == '!' ||
+					data[i] == '|' ||
+					data[i] == '%' ||
 					data[i] == '+' ||
 					data[i] == '-' ||
 					data[i] == '*' ||
@@ -184,10 +309,16 @@ func splitTokens(l *Lexer) func([]byte, bool) (int, []byte, error) {
 				}
 			}
 			if i+2 < len(data) && data[i] == '<' && data[i+1] == '!' &&
-				!bytes.EqualFold(data[i+2:i+9], []byte("doctype")) {
+				!bytes.EqualFold(data[i+2:min(i+9, len(data))], []byte("doctype")) {
 
 				// Starting HTML comment "<!--"...
-				if data[i+2] == '-' && data[i+3] == '-' {
+				if data[i+2] == '-' && i+3 < len(data) && data[i+3] == '-' {
+					if insideElem {
+						// A comment cannot be inside an element
+						// (e.g. "<!set x<!-- ..."), which is
+						// reported as an element not closed
+						return 0, nil, errElemNotClosed
+					}
 					// If we're going to keep comments, we just pass
 					// the whole comment and make it part of the next
 					// TokText token.
@@ -244,12 +375,47 @@ func (l *Lexer) lexFile(fn string) (*Tokens, error) {
 	return l.lexScanner(fn, scanner)
 }
 
+// Maximum size of a token (e.g. a big chunk of HTML text without
+// htex elements).
+const maxTokenSize = 16 * 1024 * 1024
+
 func (l *Lexer) lexScanner(fn string, scanner *bufio.Scanner) (*Tokens, error) {
 	tokens := &Tokens{}
 
+	// Position of the next token, and source code read so far (to
+	// show the line where an error is found)
+	pos := Pos{fn, 1, 1}
+	var tokenPos Pos
+	var source bytes.Buffer
+
+	split := splitTokens(l)
+	scanner.Buffer(nil, maxTokenSize)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := split(data, atEOF)
+		consumed := data[:advance]
+		if err == bufio.ErrFinalToken {
+			consumed = token
+		} else if err == errElemNotClosed {
+			// Keep the rest of the data to show the line of the
+			// element in the error
+			consumed = data
+		}
+		tokenPos = pos
+		for _, c := range consumed {
+			if c == '\n' {
+				pos.Line++
+				pos.Col = 1
+			} else {
+				pos.Col++
+			}
+		}
+		source.Write(consumed)
+		return advance, token, err
+	})
+
 	insideElem := false
+	var elemPos Pos
 	var T string
-	scanner.Split(splitTokens(l))
 
 	nextToken := true
 	for true {
@@ -261,23 +427,24 @@ func (l *Lexer) lexScanner(fn string, scanner *bufio.Scanner) (*Tokens, error) {
 			nextToken = true
 		}
 
-		token := Token{TokNone, "", false}
+		token := Token{kind: TokNone}
 
 		T = scanner.Text()
 		if len(T) > 2 && T[0] == '<' && T[1] == '!' {
 			t := strings.ToLower(T)
 			if strings.HasPrefix(t, "<!doctype") {
-				token = Token{TokText, T, false}
+				token = Token{kind: TokText, text: T, pos: tokenPos}
 			} else if strings.HasPrefix(t, "<!--") {
 				if l.KeepComments {
-					token = Token{TokText, T, false}
+					token = Token{kind: TokText, text: T, pos: tokenPos}
 				} else {
 					// Ignore the whole comment token (which includes "<!-- ... -->")
 				}
 			} else {
 				insideElem = true
+				elemPos = tokenPos
 
-				token := Token{TokElemBegin, T, false}
+				token := Token{kind: TokElemBegin, text: T, pos: tokenPos}
 				tokens.tokens = append(tokens.tokens, token)
 
 				params := 0
@@ -289,39 +456,66 @@ func (l *Lexer) lexScanner(fn string, scanner *bufio.Scanner) (*Tokens, error) {
 					}
 
 					text := scanner.Text()
-					var token Token
+					if text == "" {
+						// Whitespace after the previous token
+						tokens.tokens[len(tokens.tokens)-1].separated = true
+						l.whitespaceFound = false
+						continue
+					}
+					token := Token{text: text, separated: l.whitespaceFound, pos: tokenPos}
 					if text == "==" || text == "!=" ||
 						text == "<=" || text == ">=" ||
 						text == "<" || text == ">" || text == "=" ||
-						text == "+" || text == "-" || text == "*" || text == "/" {
-						token = Token{TokOp, text, l.whitespaceFound}
+						text == "&&" || text == "||" || text == "!" || text == ".." ||
+						text == "+" || text == "-" || text == "*" || text == "/" ||
+						text == "%" || text == "|" {
+						token.kind = TokOp
 					} else if text == "(" {
-						token = Token{TokPOpen, text, l.whitespaceFound}
+						token.kind = TokPOpen
 						params++
 					} else if text == ")" {
-						token = Token{TokPClose, text, l.whitespaceFound}
+						token.kind = TokPClose
 						params--
 					} else {
-						token = Token{TokText, text, l.whitespaceFound}
+						token.kind = TokText
 					}
 					tokens.tokens = append(tokens.tokens, token)
 					l.whitespaceFound = false
 				}
+				if scanner.Err() != nil {
+					break
+				}
 			}
 		} else if insideElem {
 			if T == ">" {
 				insideElem = false
-				token = Token{TokElemEnd, T, false}
+				token = Token{kind: TokElemEnd, text: T, pos: tokenPos}
 			} else {
-				panic("token '>' not found")
+				tokens.source = source.Bytes()
+				return nil, tokens.errorAt(tokenPos, "", "expected '>' to close the element")
 			}
 		} else if T != "" {
-			token = Token{TokText, T, false}
+			token = Token{kind: TokText, text: T, pos: tokenPos}
 		}
 		if token.kind != TokNone {
 			tokens.tokens = append(tokens.tokens, token)
 		}
 	}
+	tokens.source = source.Bytes()
+
+	if err := scanner.Err(); err != nil && err != errElemNotClosed {
+		return nil, tokens.errorAt(pos, "", "%v", err)
+	}
+	if insideElem {
+		elem := tokens.tokens[len(tokens.tokens)-1].text
+		for k := len(tokens.tokens) - 1; k >= 0; k-- {
+			if tokens.tokens[k].kind == TokElemBegin {
+				elem = tokens.tokens[k].text
+				break
+			}
+		}
+		return nil, tokens.errorAt(elemPos, elem+">", "element not closed with '>'")
+	}
 	return tokens, nil
 }
 
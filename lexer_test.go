@@ -174,6 +174,16 @@ func TestLexerElem(t *testing.T) {
 			[]Tok{TokElemBegin, TokElemEnd, TokElemBegin, TokElemEnd, TokElemBegin, TokElemEnd},
 			[]string{"<!a", ">", "<!b", ">", "<!c", ">"},
 		},
+		{
+			"<div><!a></div>",
+			[]Tok{TokText, TokElemBegin, TokElemEnd, TokText},
+			[]string{"<div>", "<!a", ">", "</div>"},
+		},
+		{
+			"<!a b=\"c d\" e=f>",
+			[]Tok{TokElemBegin, TokText, TokOp, TokText, TokText, TokOp, TokText, TokElemEnd},
+			[]string{"<!a", "b", "=", "\"c d\"", "e", "=", "f", ">"},
+		},
 	}
 	l := NewLexer()
 	testLexer(l, t, tests)
@@ -240,3 +250,108 @@ func TestLexerExpr(t *testing.T) {
 	l := NewLexer()
 	testLexer(l, t, tests)
 }
+
+func TestLexerLogicalOps(t *testing.T) {
+	tests := []LexerTest{
+		{
+			"<!if !a>",
+			[]Tok{TokElemBegin, TokOp, TokText, TokElemEnd},
+			[]string{"<!if", "!", "a", ">"},
+		},
+		{
+			"<!if a&&b || c%2>",
+			[]Tok{TokElemBegin, TokText, TokOp, TokText, TokOp, TokText, TokOp, TokText, TokElemEnd},
+			[]string{"<!if", "a", "&&", "b", "||", "c", "%", "2", ">"},
+		},
+		{
+			"<!for i in 1..n>",
+			[]Tok{TokElemBegin, TokText, TokText, TokText, TokOp, TokText, TokElemEnd},
+			[]string{"<!for", "i", "in", "1", "..", "n", ">"},
+		},
+		{
+			"<!get a|upper | truncate 6>a|b",
+			[]Tok{TokElemBegin, TokText, TokOp, TokText, TokOp, TokText, TokText, TokElemEnd, TokText},
+			[]string{"<!get", "a", "|", "upper", "|", "truncate", "6", ">", "a|b"},
+		},
+	}
+	l := NewLexer()
+	testLexer(l, t, tests)
+}
+
+func TestLexerQuotes(t *testing.T) {
+	tests := []LexerTest{
+		{
+			"<!set a \"b c\">",
+			[]Tok{TokElemBegin, TokText, TokText, TokElemEnd},
+			[]string{"<!set", "a", "\"b c\"", ">"},
+		},
+		{
+			"<!if a == 'x > y'>",
+			[]Tok{TokElemBegin, TokText, TokOp, TokText, TokElemEnd},
+			[]string{"<!if", "a", "==", "'x > y'", ">"},
+		},
+		{
+			"<!set a don't>",
+			[]Tok{TokElemBegin, TokText, TokText, TokElemEnd},
+			[]string{"<!set", "a", "don't", ">"},
+		},
+	}
+	l := NewLexer()
+	testLexer(l, t, tests)
+}
+
+func TestLexerPositions(t *testing.T) {
+	s := bufio.NewScanner(strings.NewReader("ab\n<!if x>\n\tc<!end>"))
+	result, err := NewLexer().lexScanner("test.htex", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Pos{
+		{"test.htex", 1, 1}, // "ab\n"
+		{"test.htex", 2, 1}, // "<!if"
+		{"test.htex", 2, 6}, // "x"
+		{"test.htex", 2, 7}, // ">"
+		{"test.htex", 2, 8}, // "\n\tc"
+		{"test.htex", 3, 3}, // "<!end"
+		{"test.htex", 3, 8}, // ">"
+	}
+	if len(result.tokens) != len(expected) {
+		t.Fatalf("generated %d tokens (expected %d)", len(result.tokens), len(expected))
+	}
+	for i, pos := range expected {
+		if result.tokens[i].pos != pos {
+			t.Errorf("token %d '%s' at %v (expected %v)", i, result.tokens[i].text, result.tokens[i].pos, pos)
+		}
+	}
+}
+
+func TestLexerErrors(t *testing.T) {
+	tests := []struct {
+		text string
+		err  string
+	}{
+		{"a<!get x", "test.htex:1:2: <!get> element not closed with '>'\n\ta<!get x\n\t ^"},
+		{"a\n<!if (b>c)", "test.htex:2:1: <!if> element not closed with '>'\n\t<!if (b>c)\n\t^"},
+		{"a<!", ""},
+		{"a<!-", "test.htex:1:2: <!-> element not closed with '>'\n\ta<!-\n\t ^"},
+		{"a<!doc", "test.htex:1:2: <!doc> element not closed with '>'\n\ta<!doc\n\t ^"},
+		{"<!set x<!-- a", "test.htex:1:1: <!set> element not closed with '>'\n\t<!set x<!-- a\n\t^"},
+		{"<!set x<!-- a -->", "test.htex:1:1: <!set> element not closed with '>'\n\t<!set x<!-- a -->\n\t^"},
+		{"a\n<!get <!-- x", "test.htex:2:1: <!get> element not closed with '>'\n\t<!get <!-- x\n\t^"},
+		{"<!set<!--", "test.htex:1:1: <!set> element not closed with '>'\n\t<!set<!--\n\t^"},
+		{"<!set x a><!-- b -->", ""},
+	}
+	for _, test := range tests {
+		s := bufio.NewScanner(strings.NewReader(test.text))
+		_, err := NewLexer().lexScanner("test.htex", s)
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("lexing '%s' returned an error: %v", test.text, err)
+			}
+		} else if err == nil {
+			t.Errorf("lexing '%s' should fail", test.text)
+		} else if err.Error() != test.err {
+			t.Errorf("lexing '%s' error:\n%v\n(expected)\n%s", test.text, err, test.err)
+		}
+	}
+}
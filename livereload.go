@@ -0,0 +1,245 @@
+// Copyright (c) David Capello. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE.txt file.
+
+package htex
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// URL of the Server-Sent Events used to reload the pages.
+const liveReloadUrl = "/.htex/livereload"
+
+// Script injected in HTML pages to reload them (or only their
+// stylesheets) when the server notifies a change.
+const liveReloadScript = `<script>(function(){
+var es = new EventSource("` + liveReloadUrl + `");
+es.onmessage = function(e) {
+  if (e.data == "css") {
+    document.querySelectorAll('link[rel="stylesheet"]').forEach(function(link) {
+      var url = new URL(link.href);
+      url.searchParams.set("htex-reload", Date.now());
+      link.href = url.href;
+    });
+  } else {
+    location.reload();
+  }
+};
+})();</script>
+`
+
+// fileState is used to detect changes in the files of the localRoot.
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// liveReload keeps the list of connected browsers that must be
+// notified when a file changes.
+type liveReload struct {
+	mutex    sync.Mutex
+	clients  map[chan string]struct{}
+	shutdown chan struct{} // Closed to disconnect the clients
+}
+
+// EnableLiveReload watches the files of the localRoot each interval
+// of time and reloads the pages opened in the browser when a file
+// changes (only stylesheets are reloaded if all the modified files
+// are .css files). It's used by "htex server -dev".
+func (h *Htex) EnableLiveReload(interval time.Duration) {
+	if h.liveReload != nil {
+		return
+	}
+	h.liveReload = &liveReload{
+		clients:  make(map[chan string]struct{}),
+		shutdown: make(chan struct{}),
+	}
+	go h.watchFiles(h.snapshotFiles(), interval)
+}
+
+// watchFiles polls the files of the localRoot and notifies the
+// clients when something changes.
+func (h *Htex) watchFiles(files map[string]fileState, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		newFiles := h.snapshotFiles()
+		changed := changedFiles(files, newFiles)
+		files = newFiles
+		if len(changed) == 0 {
+			continue
+		}
+		if h.verbose {
+			log.Println("files changed:", strings.Join(changed, ", "))
+		}
+		h.liveReload.broadcast(reloadMessage(changed))
+	}
+}
+
+// Directories of version control systems that are not watched.
+var vcsDirs = []string{".git", ".hg", ".svn", ".bzr", ".jj"}
+
+// snapshotFiles returns the state of all files of the localRoot
+// (excluding directories of version control systems). Hidden
+// directories are included because they can contain layouts and
+// includes (e.g. ".includes").
+func (h *Htex) snapshotFiles() map[string]fileState {
+	files := make(map[string]fileState)
+	fs.WalkDir(h.fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if slices.Contains(vcsDirs, d.Name()) {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err == nil {
+			files[name] = fileState{modTime: info.ModTime(), size: info.Size()}
+		}
+		return nil
+	})
+	return files
+}
+
+// changedFiles returns the files that were added, removed, or
+// modified between two snapshots.
+func changedFiles(before, after map[string]fileState) []string {
+	var changed []string
+	for name, state := range after {
+		old, ok := before[name]
+		if !ok || !old.modTime.Equal(state.modTime) || old.size != state.size {
+			changed = append(changed, name)
+		}
+	}
+	for name := range before {
+		if _, ok := after[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// reloadMessage returns "css" if only stylesheets were modified, or
+// "reload" to reload the whole page.
+func reloadMessage(changed []string) string {
+	for _, name := range changed {
+		if path.Ext(name) != ".css" {
+			return "reload"
+		}
+	}
+	return "css"
+}
+
+func (lr *liveReload) broadcast(msg string) {
+	lr.mutex.Lock()
+	defer lr.mutex.Unlock()
+	for client := range lr.clients {
+		select {
+		case client <- msg:
+		default:
+			// The client has a pending message
+		}
+	}
+}
+
+// disconnectAll closes the connections of the clients, e.g. when the
+// server is stopped (they would keep the server running until the
+// ShutdownTimeout).
+func (lr *liveReload) disconnectAll() {
+	lr.mutex.Lock()
+	defer lr.mutex.Unlock()
+	close(lr.shutdown)
+	lr.shutdown = make(chan struct{})
+}
+
+// serveEvents keeps the connection with the browser open to send it
+// the reload messages.
+func (lr *liveReload) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	client := make(chan string, 1)
+	lr.mutex.Lock()
+	lr.clients[client] = struct{}{}
+	shutdown := lr.shutdown
+	lr.mutex.Unlock()
+	defer func() {
+		lr.mutex.Lock()
+		delete(lr.clients, client)
+		lr.mutex.Unlock()
+	}()
+
+	// The connection is kept open more time than the WriteTimeout
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	hdr := w.Header()
+	hdr.Set("Content-Type", "text/event-stream")
+	hdr.Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case msg := <-client:
+			fmt.Fprintf(w, "data: %s\n\n", msg)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-shutdown:
+			return
+		}
+	}
+}
+
+// injectLiveReload adds the live reload script to the HTML page in
+// the given buffer (before the </body> tag if it exists, or at the
+// end of streamed pages). Pages
+// rendered inside other pages (e.g. error pages) are ignored because
+// the script is added to the outer page.
+func (h *Htex) injectLiveReload(rb *responseBuffer) {
+	if h.liveReload == nil || rb.done {
+		return
+	}
+	if _, nested := rb.ResponseWriter.(*responseBuffer); nested {
+		return
+	}
+	contentType := rb.Header().Get("Content-Type")
+	if contentType != "" && !strings.HasPrefix(contentType, "text/html") {
+		return
+	}
+	if rb.committed {
+		// The page was streamed, the script can be added only at
+		// the end
+		rb.Write([]byte(liveReloadScript))
+		return
+	}
+	body := rb.buf.Bytes()
+	i := len(body) - len("</body>")
+	for i >= 0 && !bytes.EqualFold(body[i:i+len("</body>")], []byte("</body>")) {
+		i--
+	}
+	if i < 0 {
+		rb.buf.WriteString(liveReloadScript)
+		return
+	}
+	var page bytes.Buffer
+	page.Write(body[:i])
+	page.WriteString(liveReloadScript)
+	page.Write(body[i:])
+	rb.buf = page
+}
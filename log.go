@@ -28,14 +28,25 @@ func (w *logResponseWriter) WriteHeader(statusCode int) {
 	w.w.WriteHeader(statusCode)
 }
 
+// Flush is used to stream the live reload events.
+func (w *logResponseWriter) Flush() {
+	if flusher, ok := w.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap is used by http.ResponseController.
+func (w *logResponseWriter) Unwrap() http.ResponseWriter {
+	return w.w
+}
+
 type LogHtexHandler struct {
 	handler http.Handler
-	w       logResponseWriter
 }
 
 func (h *LogHtexHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
-	h.w = logResponseWriter{w: w, code: 200}
-	h.handler.ServeHTTP(&h.w, r)
-	log.Println(" -> response code", h.w.code, "time", time.Since(start))
+	lw := logResponseWriter{w: w, code: 200}
+	h.handler.ServeHTTP(&lw, r)
+	log.Println(" -> response code", lw.code, "time", time.Since(start))
 }
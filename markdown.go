@@ -0,0 +1,335 @@
+// Copyright (c) David Capello. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE.txt file.
+
+package htex
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/gomarkdown/markdown"
+	"github.com/gomarkdown/markdown/ast"
+	mhtml "github.com/gomarkdown/markdown/html"
+	"github.com/gomarkdown/markdown/parser"
+)
+
+// MarkdownLinkHook can change the destination of the links (or the
+// images) of markdown content.
+type MarkdownLinkHook func(dest string, image bool) string
+
+// MarkdownOptions controls how markdown is converted to HTML.
+type MarkdownOptions struct {
+	Extensions       []string         `toml:"extensions,omitempty" json:"extensions,omitempty"` // Parser extensions (common extensions by default)
+	HeadingIDs       string           `toml:"heading_ids" json:"heading_ids"`                   // "auto", "custom" (only {#id}), or "none"
+	HeadingIDPrefix  string           `toml:"heading_id_prefix" json:"heading_id_prefix"`
+	TargetBlank      bool             `toml:"target_blank" json:"target_blank"`           // Open links in a new tab
+	HardLineBreaks   bool             `toml:"hard_line_breaks" json:"hard_line_breaks"`   // Convert newlines into <br>
+	Footnotes        bool             `toml:"footnotes" json:"footnotes"`                 // Pandoc-style footnotes
+	SmartPunctuation bool             `toml:"smart_punctuation" json:"smart_punctuation"` // Smart quotes, dashes, and fractions
+	MdLinks          bool             `toml:"md_links" json:"md_links"`                   // Convert links to .md files into links to their pages
+	LinkHook         MarkdownLinkHook `toml:"-" json:"-"`                                 // Rewrites links and images
+}
+
+var DefaultMarkdownOptions = MarkdownOptions{
+	HeadingIDs:       "auto",
+	TargetBlank:      true,
+	SmartPunctuation: true,
+}
+
+// Names of the markdown parser extensions
+var markdownExtensions = map[string]parser.Extensions{
+	"no-intra-emphasis":          parser.NoIntraEmphasis,
+	"tables":                     parser.Tables,
+	"fenced-code":                parser.FencedCode,
+	"autolink":                   parser.Autolink,
+	"strikethrough":              parser.Strikethrough,
+	"lax-html-blocks":            parser.LaxHTMLBlocks,
+	"space-headings":             parser.SpaceHeadings,
+	"tab-size-eight":             parser.TabSizeEight,
+	"no-empty-line-before-block": parser.NoEmptyLineBeforeBlock,
+	"backslash-line-break":       parser.BackslashLineBreak,
+	"definition-lists":           parser.DefinitionLists,
+	"mathjax":                    parser.MathJax,
+	"ordered-list-start":         parser.OrderedListStart,
+	"super-subscript":            parser.SuperSubscript,
+}
+
+// validate returns an error if the options contain an unknown
+// extension or heading IDs style.
+func (opts *MarkdownOptions) validate() error {
+	for _, name := range opts.Extensions {
+		if _, ok := markdownExtensions[name]; !ok {
+			return fmt.Errorf("unknown markdown extension '%s'", name)
+		}
+	}
+	switch opts.HeadingIDs {
+	case "", "auto", "custom", "none":
+		return nil
+	}
+	return fmt.Errorf("invalid markdown heading IDs style '%s'", opts.HeadingIDs)
+}
+
+// setAttr changes an option with an attribute of the
+// <!include-markdown> element (e.g. "target-blank=false").
+func (opts *MarkdownOptions) setAttr(name, value string) error {
+	value = unquote(value)
+	if name == "extensions" {
+		opts.Extensions = strings.FieldsFunc(value, func(r rune) bool {
+			return r == ',' || r == ' '
+		})
+		return opts.validate()
+	} else if name == "heading-ids" {
+		opts.HeadingIDs = value
+		return opts.validate()
+	} else if name == "heading-id-prefix" {
+		opts.HeadingIDPrefix = value
+		return nil
+	}
+
+	flag := opts.flag(name)
+	if flag == nil {
+		return fmt.Errorf("unknown markdown option '%s'", name)
+	}
+	if value == "" {
+		*flag = true
+		return nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("invalid value '%s' for '%s'", value, name)
+	}
+	*flag = b
+	return nil
+}
+
+// flag returns the boolean option with the given attribute name, or
+// nil if it's not a boolean option.
+func (opts *MarkdownOptions) flag(name string) *bool {
+	switch name {
+	case "target-blank":
+		return &opts.TargetBlank
+	case "hard-line-breaks":
+		return &opts.HardLineBreaks
+	case "footnotes":
+		return &opts.Footnotes
+	case "smart-punctuation":
+		return &opts.SmartPunctuation
+	case "md-links":
+		return &opts.MdLinks
+	}
+	return nil
+}
+
+// markdownToHtml converts the given markdown to HTML. If trusted is
+// false (e.g. text from the request for the "markdown" filter), the
+// raw HTML of the markdown is escaped and only safe links are
+// generated.
+func markdownToHtml(md []byte, opts MarkdownOptions, trusted bool) []byte {
+	extensions := parser.CommonExtensions | parser.NoEmptyLineBeforeBlock
+	if opts.Extensions != nil {
+		extensions = parser.NoExtensions
+		for _, name := range opts.Extensions {
+			extensions |= markdownExtensions[name]
+		}
+	}
+	switch opts.HeadingIDs {
+	case "", "auto":
+		extensions |= parser.HeadingIDs | parser.AutoHeadingIDs
+	case "custom":
+		extensions |= parser.HeadingIDs
+	case "none":
+		extensions &^= parser.HeadingIDs | parser.AutoHeadingIDs
+	}
+	if opts.HardLineBreaks {
+		extensions |= parser.HardLineBreak
+	}
+	if opts.Footnotes {
+		extensions |= parser.Footnotes
+	}
+	p := parser.NewWithExtensions(extensions)
+	doc := p.Parse(md)
+
+	if opts.MdLinks || opts.LinkHook != nil {
+		ast.WalkFunc(doc, func(node ast.Node, entering bool) ast.WalkStatus {
+			if entering {
+				switch n := node.(type) {
+				case *ast.Link:
+					n.Destination = []byte(opts.rewriteLink(string(n.Destination), false))
+				case *ast.Image:
+					n.Destination = []byte(opts.rewriteLink(string(n.Destination), true))
+				}
+			}
+			return ast.GoToNext
+		})
+	}
+
+	htmlFlags := mhtml.FlagsNone
+	if opts.TargetBlank {
+		htmlFlags |= mhtml.HrefTargetBlank
+	}
+	if opts.SmartPunctuation {
+		htmlFlags |= mhtml.CommonFlags
+	}
+	if opts.Footnotes {
+		htmlFlags |= mhtml.FootnoteReturnLinks
+	}
+	rendererOpts := mhtml.RendererOptions{
+		Flags:           htmlFlags,
+		HeadingIDPrefix: opts.HeadingIDPrefix,
+	}
+	if !trusted {
+		rendererOpts.Flags |= mhtml.Safelink
+		rendererOpts.RenderNodeHook = escapeRawHtml
+	}
+	return markdown.Render(doc, mhtml.NewRenderer(rendererOpts))
+}
+
+// escapeRawHtml is a render hook that prints the raw HTML of the
+// markdown as text.
+func escapeRawHtml(w io.Writer, node ast.Node, entering bool) (ast.WalkStatus, bool) {
+	switch n := node.(type) {
+	case *ast.HTMLSpan:
+		mhtml.EscapeHTML(w, n.Literal)
+		return ast.GoToNext, true
+	case *ast.HTMLBlock:
+		io.WriteString(w, "<p>")
+		mhtml.EscapeHTML(w, n.Literal)
+		io.WriteString(w, "</p>\n")
+		return ast.GoToNext, true
+	}
+	return ast.GoToNext, false
+}
+
+// rewriteLink returns the new destination of a link or an image.
+func (opts *MarkdownOptions) rewriteLink(dest string, image bool) string {
+	if opts.MdLinks && !image {
+		dest = mdLinkToRoute(dest)
+	}
+	if opts.LinkHook != nil {
+		dest = opts.LinkHook(dest, image)
+	}
+	return dest
+}
+
+// mdLinkToRoute converts a local link to a markdown page to a link to
+// its route (e.g. "intro.md#usage" to "intro#usage", or
+// "docs/index.md" to "docs/").
+func mdLinkToRoute(dest string) string {
+	u, err := url.Parse(dest)
+	if err != nil || u.Scheme != "" || u.Host != "" {
+		return dest
+	}
+	route, found := strings.CutSuffix(u.Path, ".md")
+	if !found {
+		return dest
+	}
+	if path.Base(route) == "index" {
+		route = strings.TrimSuffix(route, "index")
+		if route == "" {
+			route = "./"
+		}
+	}
+	u.Path = route
+	return u.String()
+}
+
+// parseFrontMatter separates the YAML (between "---" lines) or TOML
+// (between "+++" lines) front matter from the content of a markdown
+// file.
+func parseFrontMatter(content []byte) (map[string]any, []byte, error) {
+	var ext string
+	delim, rest, _ := bytes.Cut(content, []byte("\n"))
+	switch string(bytes.TrimRight(delim, " \t\r")) {
+	case "---":
+		ext = ".yaml"
+	case "+++":
+		ext = ".toml"
+	default:
+		return nil, content, nil
+	}
+
+	// Find the closing delimiter line
+	var frontMatter []byte
+	for pos := 0; ; {
+		line, next, found := bytes.Cut(rest[pos:], []byte("\n"))
+		if bytes.Equal(bytes.TrimRight(line, " \t\r"), delim[:3]) {
+			frontMatter = rest[:pos]
+			rest = next
+			break
+		}
+		if !found {
+			return nil, nil, fmt.Errorf("front matter not closed with '%s'", delim[:3])
+		}
+		pos = len(rest) - len(next)
+	}
+
+	data, err := parseData(ext, frontMatter)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid front matter: %w", err)
+	}
+	vars, ok := data.(map[string]any)
+	if !ok {
+		if data != nil {
+			return nil, nil, fmt.Errorf("invalid front matter: expected variables")
+		}
+		vars = make(map[string]any)
+	}
+	return vars, rest, nil
+}
+
+// parseMarkdownFile converts a markdown page into a HtexFile with
+// the rendered HTML, the layout and the variables of its front
+// matter.
+func (h *Htex) parseMarkdownFile(fn string) (*HtexFile, error) {
+	info, err := h.stat(fn)
+	if err != nil {
+		h.cache.remove(fn)
+		return nil, err
+	}
+	if !h.DisableCache {
+		if hf := h.cache.get(fn, info); hf != nil {
+			if h.verbose {
+				log.Println(" -> cached file", fn)
+			}
+			return hf, nil
+		}
+	}
+
+	if h.verbose {
+		log.Println(" -> parse markdown file", fn)
+	}
+
+	content, err := h.readFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	vars, md, err := parseFrontMatter(content)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fn, err)
+	}
+
+	hf := &HtexFile{fn: fn, defines: make(map[string]int), vars: vars}
+	if layout, ok := vars["layout"]; ok {
+		layoutFn := toString(layout)
+		if layoutFn == "" {
+			return nil, fmt.Errorf("%s: invalid layout", fn)
+		}
+		hf.elems = append(hf.elems, Elem{kind: ElemLayout, text: h.solveUrlPathToLocalPath(fn, layoutFn), pos: Pos{fn, 1, 1}})
+	}
+	if draft, ok := vars["draft"].(bool); ok {
+		hf.draft = draft
+	}
+	hf.elems = append(hf.elems, newElem(ElemText, string(markdownToHtml(md, h.Markdown, true))))
+
+	if !h.DisableCache {
+		h.cache.put(fn, info, hf)
+	}
+	return hf, nil
+}
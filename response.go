@@ -0,0 +1,197 @@
+// Copyright (c) David Capello. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE.txt file.
+
+package htex
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Extra time to write the end of a streamed page after
+// MaxStreamDuration expires.
+const streamGracePeriod = 5 * time.Second
+
+var errStreamTimeout = errors.New("max stream duration exceeded")
+
+// responseBuffer keeps the output of a page in memory until the page
+// is completely rendered, so the elements that modify the response
+// (<!status>, <!header>, <!cookie>, <!redirect>, and
+// <!content-type>) can be used anywhere in the page or its layouts.
+//
+// The page can be streamed with <!flush>, which sends the output
+// rendered so far, and the rest of the page is sent while it's
+// rendered.
+type responseBuffer struct {
+	http.ResponseWriter
+	buf       bytes.Buffer
+	code      int
+	committed bool // True if the status and headers were sent
+	done      bool // True if the page must not render anything else
+
+	ctx       context.Context // Context of the page (canceled when the stream expires)
+	expire    func()          // Cancels ctx when maxStream expires
+	maxStream time.Duration
+	timer     *time.Timer
+}
+
+func newResponseBuffer(w http.ResponseWriter) *responseBuffer {
+	return &responseBuffer{ResponseWriter: w, code: http.StatusOK}
+}
+
+func (w *responseBuffer) Write(buf []byte) (int, error) {
+	if w.stopped() {
+		return len(buf), nil
+	}
+	if w.committed {
+		return w.ResponseWriter.Write(buf)
+	}
+	return w.buf.Write(buf)
+}
+
+func (w *responseBuffer) WriteHeader(statusCode int) {
+	if !w.committed {
+		w.code = statusCode
+	}
+}
+
+// redirect discards the output and stops rendering the page.
+func (w *responseBuffer) redirect(r *http.Request, url string, code int) {
+	w.buf.Reset()
+	http.Redirect(w, r, url, code)
+	w.done = true
+}
+
+// commit sends the status code, headers, and the buffered output.
+func (w *responseBuffer) commit() {
+	if !w.committed {
+		w.committed = true
+		w.ResponseWriter.WriteHeader(w.code)
+		w.ResponseWriter.Write(w.buf.Bytes())
+		w.buf.Reset()
+	}
+}
+
+// streamFor limits the time that the page can be streamed after the
+// first Flush() (0 = no limit). It returns the request with the
+// context of the page, which is canceled when the time expires to
+// stop the rendering and the running commands, and a function to
+// release the resources when the page is finished.
+func (w *responseBuffer) streamFor(r *http.Request, maxStream time.Duration) (*http.Request, func()) {
+	ctx, cancel := context.WithCancelCause(r.Context())
+	urlPath := r.URL.Path
+	w.ctx = ctx
+	w.maxStream = maxStream
+	w.expire = func() {
+		log.Println(urlPath, "stream terminated after", maxStream)
+		cancel(errStreamTimeout)
+	}
+	return r.WithContext(ctx), func() {
+		if w.timer != nil {
+			w.timer.Stop()
+		}
+		cancel(nil)
+	}
+}
+
+// Flush sends the status code, headers, and the output rendered so
+// far to the client. After that, the status code and headers cannot
+// be modified, and the output is sent as soon as it's written.
+func (w *responseBuffer) Flush() {
+	if w.stopped() {
+		return
+	}
+	if !w.committed && w.expire != nil {
+		// The WriteTimeout of the server is replaced with the
+		// max stream duration
+		rc := http.NewResponseController(w.ResponseWriter)
+		if w.maxStream > 0 {
+			rc.SetWriteDeadline(time.Now().Add(w.maxStream + streamGracePeriod))
+			w.timer = time.AfterFunc(w.maxStream, w.expire)
+		} else {
+			rc.SetWriteDeadline(time.Time{})
+		}
+	}
+	w.commit()
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// stopped returns true if the page must not render anything else
+// (e.g. after a <!redirect>, or when the stream expires or the
+// client disconnects).
+func (w *responseBuffer) stopped() bool {
+	return w.done || (w.ctx != nil && w.ctx.Err() != nil)
+}
+
+// isDone returns true if the rendering of the page must stop
+// (e.g. after a <!redirect>).
+func isDone(w http.ResponseWriter) bool {
+	rb, ok := w.(*responseBuffer)
+	return ok && rb.stopped()
+}
+
+// isStreaming returns true if the output of the page is sent to the
+// client as soon as it's written (after <!flush>).
+func isStreaming(w http.ResponseWriter) bool {
+	rb, ok := w.(*responseBuffer)
+	return ok && rb.committed
+}
+
+// parseStatusCode parses the HTTP status code of <!status> and
+// <!redirect> elements.
+func parseStatusCode(text string) (int, error) {
+	code, err := strconv.Atoi(text)
+	if err != nil || code < 100 || code > 999 {
+		return 0, fmt.Errorf("invalid status code '%s'", text)
+	}
+	return code, nil
+}
+
+// setCookieAttr sets an attribute of a <!cookie> element, e.g.
+// "path=/", "max-age=3600", "secure", "httponly", or "samesite=lax".
+func setCookieAttr(cookie *http.Cookie, attr string) error {
+	name, value, _ := strings.Cut(attr, "=")
+	value = unquote(value)
+	switch strings.ToLower(name) {
+	case "path":
+		cookie.Path = value
+	case "domain":
+		cookie.Domain = value
+	case "max-age":
+		maxAge, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid cookie max-age '%s'", value)
+		}
+		if maxAge <= 0 {
+			// Delete the cookie now
+			maxAge = -1
+		}
+		cookie.MaxAge = maxAge
+	case "secure":
+		cookie.Secure = true
+	case "httponly":
+		cookie.HttpOnly = true
+	case "samesite":
+		switch strings.ToLower(value) {
+		case "lax":
+			cookie.SameSite = http.SameSiteLaxMode
+		case "strict":
+			cookie.SameSite = http.SameSiteStrictMode
+		case "none":
+			cookie.SameSite = http.SameSiteNoneMode
+		default:
+			return fmt.Errorf("invalid cookie samesite '%s'", value)
+		}
+	default:
+		return fmt.Errorf("invalid cookie attribute '%s'", name)
+	}
+	return nil
+}
@@ -5,28 +5,38 @@
 package htex
 
 import (
-	"os"
+	"io/fs"
+	"log"
 	"path"
 	"path/filepath"
 	"strings"
 )
 
 func (h *Htex) ScanFiles(dynamicQuery, staticFile func(fullFn, query string)) {
-	filepath.Walk(h.localRoot, func(fullFn string, info os.FileInfo, err error) error {
-		fn := filepath.ToSlash(fullFn[len(h.localRoot):])
+	fs.WalkDir(h.fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			log.Print(err)
+			return nil
+		}
+		fullFn := filepath.Join(h.localRoot, filepath.FromSlash(name))
+		fn := path.Join("/", name)
 
 		// Skip hidden files folders
-		if info.IsDir() {
+		if d.IsDir() {
 			if strings.HasPrefix(fn, "/.") &&
 				!strings.HasPrefix(fn, "/.well-known") {
-				return filepath.SkipDir
+				return fs.SkipDir
 			}
 			return nil
 		}
 
 		var query string
 		ext := path.Ext(fn)
-		if ext == ".htex" {
+		if ext == ".md" && h.isRegularFile(strings.TrimSuffix(fullFn, ext)+".htex") {
+			// The .htex page is used instead of the markdown page
+			return nil
+		}
+		if ext == ".htex" || ext == ".md" {
 			// Convert the filename into a URL pattern
 			query = fn[:len(fn)-len(ext)]
 			queryLen := len(query)
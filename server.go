@@ -0,0 +1,125 @@
+// Copyright (c) David Capello. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE.txt file.
+
+package htex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// ServerConfig contains the limits of the web server started with
+// Htex.RunWebServer(). A zero value means no limit.
+type ServerConfig struct {
+	ReadTimeout     time.Duration // Time to read a request (including the body)
+	WriteTimeout    time.Duration // Time to write a response
+	IdleTimeout     time.Duration // Time to wait the next request of a keep-alive connection
+	MaxHeaderBytes  int           // Max size of the request headers
+	ShutdownTimeout time.Duration // Time to finish the active requests when the server is stopped
+
+	// Max time to stream a page after <!flush> (it replaces the
+	// WriteTimeout of the page)
+	MaxStreamDuration time.Duration
+}
+
+var DefaultServerConfig = ServerConfig{
+	ReadTimeout:     30 * time.Second,
+	WriteTimeout:    60 * time.Second,
+	IdleTimeout:     120 * time.Second,
+	MaxHeaderBytes:  1 << 20,
+	ShutdownTimeout: 30 * time.Second,
+
+	MaxStreamDuration: 5 * time.Minute,
+}
+
+// NewServer returns an http.Server configured with h.Server options
+// to serve the htex files in the given address (e.g. ":8080").
+func (h *Htex) NewServer(addr string) *http.Server {
+	srv := &http.Server{
+		Addr:           addr,
+		Handler:        h.HttpHandler,
+		ReadTimeout:    h.Server.ReadTimeout,
+		WriteTimeout:   h.Server.WriteTimeout,
+		IdleTimeout:    h.Server.IdleTimeout,
+		MaxHeaderBytes: h.Server.MaxHeaderBytes,
+	}
+	// Live reload connections never finish by themselves
+	srv.RegisterOnShutdown(func() {
+		if h.liveReload != nil {
+			h.liveReload.disconnectAll()
+		}
+	})
+	return srv
+}
+
+// RunWebServer starts a web server in the given port (80 or 443 by
+// default) until the process receives a SIGINT or SIGTERM signal.
+// HTTPS is used if the fullchain and privkey files are specified.
+func (h *Htex) RunWebServer(port int, fullchain string, privkey string) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return h.RunWebServerContext(ctx, port, fullchain, privkey)
+}
+
+// RunWebServerContext is like RunWebServer() but the server is
+// stopped when the given context is done. Active requests have
+// h.Server.ShutdownTimeout to finish.
+func (h *Htex) RunWebServerContext(ctx context.Context, port int, fullchain string, privkey string) error {
+	if !h.isDir(h.localRoot) {
+		return fmt.Errorf("cannot open directory: %s", h.localRoot)
+	}
+
+	useTLS := (fullchain != "" && privkey != "")
+	if port == 0 {
+		if useTLS {
+			port = 443
+		} else {
+			port = 80
+		}
+	}
+	srv := h.NewServer(fmt.Sprint(":", port))
+
+	errs := make(chan error, 1)
+	go func() {
+		if useTLS {
+			fmt.Printf("htex server at https://localhost:%d for %s\n", port, h.localRoot)
+			errs <- srv.ListenAndServeTLS(fullchain, privkey)
+		} else {
+			fmt.Printf("htex server at http://localhost:%d for %s\n", port, h.localRoot)
+			errs <- srv.ListenAndServe()
+		}
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	if h.verbose {
+		log.Println("shutting down server")
+	}
+	shutdownCtx := context.Background()
+	if h.Server.ShutdownTimeout > 0 {
+		var cancel context.CancelFunc
+		shutdownCtx, cancel = context.WithTimeout(shutdownCtx, h.Server.ShutdownTimeout)
+		defer cancel()
+	}
+	err := srv.Shutdown(shutdownCtx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		// Close the connections of the requests that didn't finish
+		srv.Close()
+	}
+	if serveErr := <-errs; !errors.Is(serveErr, http.ErrServerClosed) && err == nil {
+		err = serveErr
+	}
+	return err
+}
@@ -0,0 +1,259 @@
+// Copyright (c) David Capello. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE.txt file.
+
+package htex
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// UploadPolicy controls the multipart/form-data requests used to
+// upload files.
+type UploadPolicy struct {
+	Dir       string `toml:"dir,omitempty" json:"dir,omitempty"` // Directory where <!upload-save> saves the files (outside the root directory)
+	MaxSize   int64  `toml:"max_size" json:"max_size"`           // Max size of the request body in bytes (0 = no limit)
+	MaxMemory int64  `toml:"max_memory" json:"max_memory"`       // Bigger files are kept in temporary files while the request is handled
+}
+
+var DefaultUploadPolicy = UploadPolicy{
+	MaxSize:   32 << 20,
+	MaxMemory: 1 << 20,
+}
+
+type uploadsKey struct{}
+
+// requestUploads keeps the files of a request that were saved with
+// <!upload-save> or copied to temporary files to pass them to <!exec>
+// commands.
+type requestUploads struct {
+	form  *multipart.Form
+	saved map[string]string // Saved file of each field
+	temp  map[string]string // Temporary file of each field
+}
+
+// parseRequestForm parses the form of the request, including the
+// files of multipart/form-data requests. It returns the request with
+// the uploaded files in its context.
+func (h *Htex) parseRequestForm(w http.ResponseWriter, r *http.Request) (*http.Request, error) {
+	contentType := r.Header.Get("Content-Type")
+	if !strings.HasPrefix(contentType, "multipart/form-data") ||
+		(r.Method != "POST" && r.Method != "PUT" && r.Method != "PATCH") {
+		r.ParseForm()
+		return r, nil
+	}
+	if h.Upload.MaxSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, h.Upload.MaxSize)
+	}
+	if err := r.ParseMultipartForm(h.Upload.MaxMemory); err != nil {
+		return r, err
+	}
+	u := &requestUploads{
+		form:  r.MultipartForm,
+		saved: make(map[string]string),
+		temp:  make(map[string]string),
+	}
+	return r.WithContext(context.WithValue(r.Context(), uploadsKey{}, u)), nil
+}
+
+// formErrorCode returns the status code to respond when the form of
+// a request cannot be parsed.
+func formErrorCode(err error) int {
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// removeUploads deletes the temporary files of the request.
+func removeUploads(r *http.Request) {
+	u := getUploads(r)
+	if u == nil {
+		return
+	}
+	for _, fn := range u.temp {
+		os.Remove(fn)
+	}
+	u.form.RemoveAll()
+}
+
+func getUploads(r *http.Request) *requestUploads {
+	u, _ := r.Context().Value(uploadsKey{}).(*requestUploads)
+	return u
+}
+
+// file returns the first file uploaded in the given field (or nil if
+// there is no file).
+func (u *requestUploads) file(field string) *multipart.FileHeader {
+	if u == nil {
+		return nil
+	}
+	files := u.form.File[field]
+	if len(files) == 0 {
+		return nil
+	}
+	return files[0]
+}
+
+// uploadAttr returns the attribute of <!upload field attr> for the
+// file of the given field (or nil if there is no file).
+func uploadAttr(r *http.Request, field, attr string) any {
+	u := getUploads(r)
+	fh := u.file(field)
+	if fh == nil {
+		return nil
+	}
+	switch attr {
+	case "name":
+		return fh.Filename
+	case "size":
+		return float64(fh.Size)
+	case "type":
+		return fh.Header.Get("Content-Type")
+	case "file":
+		if fn, ok := u.saved[field]; ok {
+			return filepath.Base(fn)
+		}
+	}
+	return nil
+}
+
+// isUploadAttr returns true if the given name is an attribute of
+// <!upload field attr>.
+func isUploadAttr(name string) bool {
+	return name == "name" || name == "size" || name == "type" || name == "file"
+}
+
+// isInsideDir returns true if the given path is the dir directory or
+// one of its subdirectories.
+func isInsideDir(fn, dir string) bool {
+	fn, err1 := filepath.Abs(fn)
+	dir, err2 := filepath.Abs(dir)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	rel, err := filepath.Rel(dir, fn)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// safeFileName returns the base name of an uploaded file replacing
+// the characters that are not safe in a file name.
+func safeFileName(original string) string {
+	name := path.Base(strings.ReplaceAll(original, `\`, "/"))
+	name = strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') ||
+			r == '.' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+	name = strings.TrimLeft(name, ".")
+	if len(name) > 100 {
+		name = name[len(name)-100:]
+	}
+	if name == "" {
+		name = "file"
+	}
+	return name
+}
+
+// uploadFileName returns a unique name to save an uploaded file that
+// keeps the safe characters of the original name, e.g.
+// "20250102-150405-1a2b3c4d-report.pdf".
+func uploadFileName(original string) string {
+	id := make([]byte, 4)
+	rand.Read(id)
+	return time.Now().Format("20060102-150405") + "-" + hex.EncodeToString(id) + "-" + safeFileName(original)
+}
+
+// copyUpload copies the given uploaded file to a new file.
+func copyUpload(fh *multipart.FileHeader, dst *os.File) error {
+	src, err := fh.Open()
+	if err != nil {
+		dst.Close()
+		return err
+	}
+	defer src.Close()
+	_, err = io.Copy(dst, src)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst.Name())
+	}
+	return err
+}
+
+// saveUpload saves the file of the given field in the upload
+// directory (<!upload-save field>). Nothing is done if the field
+// doesn't contain a file.
+func (h *Htex) saveUpload(r *http.Request, field string) error {
+	u := getUploads(r)
+	fh := u.file(field)
+	if fh == nil {
+		return nil
+	}
+	if _, ok := u.saved[field]; ok {
+		return nil
+	}
+	dir := h.Upload.Dir
+	if dir == "" {
+		return errors.New("upload directory is not configured")
+	}
+	if h.execDir != "" && isInsideDir(dir, h.localRoot) {
+		return fmt.Errorf("upload directory %s is inside the root directory", dir)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	fn := filepath.Join(dir, uploadFileName(fh.Filename))
+	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if err := copyUpload(fh, f); err != nil {
+		return fmt.Errorf("cannot save '%s': %w", fh.Filename, err)
+	}
+	u.saved[field] = fn
+	return nil
+}
+
+// uploadPath returns the path of the file of the given field to pass
+// it to an <!exec> command (${upload.field}). If the file wasn't
+// saved with <!upload-save>, it's copied to a temporary file that is
+// deleted after the request.
+func uploadPath(r *http.Request, field string) (string, error) {
+	u := getUploads(r)
+	fh := u.file(field)
+	if fh == nil {
+		return "", nil
+	}
+	if fn, ok := u.saved[field]; ok {
+		return fn, nil
+	}
+	if fn, ok := u.temp[field]; ok {
+		return fn, nil
+	}
+	f, err := os.CreateTemp("", "htex-upload-*-"+safeFileName(fh.Filename))
+	if err != nil {
+		return "", err
+	}
+	if err := copyUpload(fh, f); err != nil {
+		return "", err
+	}
+	u.temp[field] = f.Name()
+	return f.Name(), nil
+}